@@ -7,6 +7,15 @@ import (
 type AccessRecord struct {
 	Time       time.Time `db:"time" json:"time"`
 	ClientTime time.Time `db:"client_time" json:"clientTime"`
+	// inbound or outbound
+	Kind string `db:"kind" json:"kind"`
+	// correlation
+	RequestID    string `db:"request_id" json:"requestID"`
+	TraceID      string `db:"trace_id" json:"traceID"`
+	SpanID       string `db:"span_id" json:"spanID"`
+	ParentSpanID string `db:"parent_span_id" json:"parentSpanID"`
+	TraceState   string `db:"trace_state" json:"traceState"`
+	TraceFlags   string `db:"-" json:"-"`
 	// from context
 	RedisDurationUs   uint64  `db:"redis_duration_us" json:"redisDurationUs"`
 	Host              string  `db:"host" json:"host"`
@@ -29,11 +38,23 @@ type AccessRecord struct {
 	IsInEuropeanUnion bool    `db:"eu_member" json:"euMember"`
 	DurationUs        uint64  `db:"duration_us" json:"durationUs"`
 	DBDurationUs      uint64  `db:"db_duration_us" json:"dbDurationUs"`
+	DBQueries         uint32  `db:"db_queries" json:"dbQueries"`
+	DBSlowestUs       uint64  `db:"db_slowest_us" json:"dbSlowestUs"`
+	DBSlowestQuery    string  `db:"db_slowest_query" json:"dbSlowestQuery"`
+	RedisCalls        uint32  `db:"redis_calls" json:"redisCalls"`
 	// from headers
 	OS      string `db:"os" json:"os"`
 	Browser string `db:"browser" json:"browser"`
 	Width   uint32 `db:"width" json:"width"`
 	Height  uint32 `db:"height" json:"height"`
+	// from User-Agent
+	OSVersion      string `db:"os_version" json:"osVersion"`
+	BrowserVersion string `db:"browser_version" json:"browserVersion"`
+	DeviceType     string `db:"device_type" json:"deviceType"`
+	IsBot          bool   `db:"is_bot" json:"isBot"`
+	BotName        string `db:"bot_name" json:"botName"`
+	BotVerified    bool   `db:"bot_verified" json:"botVerified"`
+	HostingOrg     string `db:"hosting_org" json:"hostingOrg"`
 	// from request
 	User             string `db:"user" json:"user"`
 	UserAgent        string `db:"user_agent" json:"userAgent"`
@@ -44,11 +65,20 @@ type AccessRecord struct {
 	ClientBranch     string `db:"client_branch" json:"clientBranch"`
 	ClientCommitHash string `db:"client_commit_hash" json:"clientCommitHash"`
 	ClientTag        string `db:"client_tag" json:"clientTag"`
-	// from response
+	// allowlisted headers
+	RequestHeaders  map[string]string `db:"request_headers" json:"requestHeaders,omitempty"`
+	ResponseHeaders map[string]string `db:"response_headers" json:"responseHeaders,omitempty"`
+	// from response, 0 for gRPC which has RPCCode instead
 	Status         uint16 `db:"status" json:"status"`
 	Response       string `db:"response" json:"response"`
 	ResponseLength uint64 `db:"response_length" json:"responseLength"`
 	Error          string `db:"error" json:"error"`
+	// gRPC only
+	RPCCode          string `db:"rpc_code" json:"rpcCode"`
+	RequestMessages  uint32 `db:"request_messages" json:"requestMessages"`
+	ResponseMessages uint32 `db:"response_messages" json:"responseMessages"`
+	// share of similar requests which were logged
+	SampleRate float64 `db:"sample_rate" json:"sampleRate"`
 	// from app
 	Region     string `db:"region" json:"region"`
 	Location   string `db:"location" json:"location"`
@@ -57,11 +87,14 @@ type AccessRecord struct {
 	Tag        string `db:"tag" json:"tag"`
 }
 
-func (ar *AccessRecord) Send() {
-	records <- *ar
+// Send redacts the record and queues it to the logger and sinks of the
+// middleware
+func (m *Middleware) Send(ar *AccessRecord) {
+	m.settings().redactor.Record(ar)
+	m.send(*ar)
 }
 
 func (ar *AccessRecord) GetAvailableFields() []string {
-	fields, _ := StructFields(ar, "db", []string{})
+	fields, _ := StructFields(ar, "db", []string{"-"})
 	return fields
 }
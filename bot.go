@@ -0,0 +1,357 @@
+package ECMSLogger
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBotVerifyTimeout = 300 * time.Millisecond
+	defaultBotCacheTTL      = time.Hour
+	defaultBotFailureTTL    = time.Minute
+	botCacheSize            = 8192
+	// lookups running at once, requests of other crawlers are not verified
+	// until one finishes
+	maxBotLookups = 64
+	// how long a classifier replaced by Reload stays open for requests which
+	// took it before
+	replacedBotClassifierTTL = 30 * time.Second
+)
+
+// Resolver is satisfied by *net.Resolver. Tests and services with their own
+// DNS caching can pass a different implementation.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Crawlers which publish reverse DNS domains can be verified with
+// forward-confirmed reverse DNS.
+var builtinBotPatterns = []BotPattern{
+	{Name: "Googlebot", Regex: `Googlebot|AdsBot-Google|Mediapartners-Google|Google-InspectionTool`, Domains: []string{"googlebot.com", "google.com", "googleusercontent.com"}},
+	{Name: "Bingbot", Regex: `(?i)bingbot|BingPreview|msnbot`, Domains: []string{"search.msn.com"}},
+	{Name: "YandexBot", Regex: `Yandex(?:Bot|MobileBot|Images|Metrika|Direct)`, Domains: []string{"yandex.ru", "yandex.net", "yandex.com"}},
+	{Name: "Baiduspider", Regex: `Baiduspider`, Domains: []string{"baidu.com", "baidu.jp"}},
+	{Name: "Applebot", Regex: `Applebot`, Domains: []string{"applebot.apple.com"}},
+	{Name: "Yahoo Slurp", Regex: `Yahoo! Slurp`, Domains: []string{"crawl.yahoo.net"}},
+	{Name: "DuckDuckBot", Regex: `DuckDuckBot`},
+	{Name: "PetalBot", Regex: `PetalBot`, Domains: []string{"petalsearch.com"}},
+	{Name: "AhrefsBot", Regex: `AhrefsBot`},
+	{Name: "SemrushBot", Regex: `SemrushBot`},
+	{Name: "MJ12bot", Regex: `MJ12bot`},
+	{Name: "Facebook", Regex: `facebookexternalhit|Facebot`},
+	{Name: "Twitterbot", Regex: `Twitterbot`},
+	{Name: "curl", Regex: `^curl/`},
+	{Name: "Wget", Regex: `^Wget/`},
+	{Name: "python-requests", Regex: `^python-requests/|^Python-urllib/`},
+	{Name: "Go-http-client", Regex: `^Go-http-client/`},
+	{Name: "HeadlessChrome", Regex: `HeadlessChrome`},
+}
+
+var defaultHostingOrgs = []string{
+	"amazon", "google cloud", "microsoft", "digitalocean", "hetzner", "ovh",
+	"linode", "akamai", "vultr", "choopa", "alibaba", "tencent", "oracle",
+	"scaleway", "contabo", "leaseweb",
+}
+
+type BotInfo struct {
+	IsBot    bool
+	Name     string
+	Verified bool
+	// organization of the hosting network the request came from. It is a
+	// signal only: VPNs and corporate proxies run there too.
+	HostingOrg string
+}
+
+type botRule struct {
+	name    string
+	re      *regexp.Regexp
+	domains []string
+}
+
+type botVerification struct {
+	ok      bool
+	expires time.Time
+}
+
+// botCache keeps verification results, the least recently used one is
+// evicted when it is full
+type botCache struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type botCacheEntry struct {
+	key string
+	v   botVerification
+}
+
+func newBotCache(size int) *botCache {
+	return &botCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *botCache) get(key string) (botVerification, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return botVerification{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*botCacheEntry).v, true
+}
+
+func (c *botCache) add(key string, v botVerification) {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*botCacheEntry).v = v
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&botCacheEntry{key, v})
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*botCacheEntry).key)
+	}
+}
+
+type BotClassifier struct {
+	rules       []botRule
+	verify      bool
+	resolver    Resolver
+	timeout     time.Duration
+	cacheTTL    time.Duration
+	failureTTL  time.Duration
+	asn         *geoip2.Reader
+	hostingOrgs []string
+	hostingASNs map[uint]bool
+	Skip        bool
+	mu          sync.Mutex
+	cache       *botCache
+	// keys of lookups in progress
+	pending map[string]bool
+	lookups sync.WaitGroup
+	closed  bool
+}
+
+// NewBotClassifier compiles bot rules. Custom patterns are checked before the
+// builtin ones. A nil resolver means net.DefaultResolver.
+func NewBotClassifier(b *Bots, resolver Resolver) (*BotClassifier, error) {
+	bc := &BotClassifier{
+		verify:      b.Verify,
+		resolver:    resolver,
+		timeout:     b.Timeout,
+		cacheTTL:    b.CacheTTL,
+		failureTTL:  b.FailureTTL,
+		hostingASNs: make(map[uint]bool, len(b.HostingASNs)),
+		Skip:        b.Skip,
+		cache:       newBotCache(botCacheSize),
+		pending:     make(map[string]bool),
+	}
+	if bc.resolver == nil {
+		bc.resolver = net.DefaultResolver
+	}
+	if bc.timeout == 0 {
+		bc.timeout = defaultBotVerifyTimeout
+	}
+	if bc.cacheTTL == 0 {
+		bc.cacheTTL = defaultBotCacheTTL
+	}
+	if bc.failureTTL == 0 {
+		bc.failureTTL = defaultBotFailureTTL
+	}
+	for _, p := range append(append([]BotPattern{}, b.Patterns...), builtinBotPatterns...) {
+		if p.Name == "" {
+			return nil, errors.New("Bot pattern without name: " + p.Regex)
+		}
+		re, err := regexp.Compile(p.Regex)
+		if err != nil {
+			return nil, errors.New("Wrong bot regex for " + p.Name + ": " + err.Error())
+		}
+		bc.rules = append(bc.rules, botRule{name: p.Name, re: re, domains: p.Domains})
+	}
+	if b.ASNDB != "" {
+		asn, err := geoip2.Open(b.ASNDB)
+		if err != nil {
+			return nil, err
+		}
+		bc.asn = asn
+		orgs := b.HostingOrgs
+		if len(orgs) == 0 {
+			orgs = defaultHostingOrgs
+		}
+		for _, o := range orgs {
+			bc.hostingOrgs = append(bc.hostingOrgs, strings.ToLower(o))
+		}
+		for _, n := range b.HostingASNs {
+			bc.hostingASNs[n] = true
+		}
+	}
+	return bc, nil
+}
+
+// Classify checks user agent rules first, then the result of the user agent
+// parser. Claims of verifiable crawlers are confirmed with reverse and forward
+// DNS lookups when enabled. The network the request came from is recorded in
+// HostingOrg and does not make a request a bot on its own. Neither does an
+// empty user agent: such requests stay unclassified, the empty user_agent
+// column tells them apart.
+func (bc *BotClassifier) Classify(ua string, ip net.IP, info UAInfo) BotInfo {
+	res := BotInfo{}
+	res.HostingOrg, _ = bc.hosting(ip)
+	if ua == "" {
+		return res
+	}
+	for _, r := range bc.rules {
+		if !r.re.MatchString(ua) {
+			continue
+		}
+		res.IsBot, res.Name = true, r.name
+		if bc.verify && len(r.domains) > 0 && ip != nil {
+			res.Verified = bc.verified(ip, r)
+		}
+		return res
+	}
+	if info.IsBot {
+		res.IsBot, res.Name = true, info.Browser
+	}
+	return res
+}
+
+// verified returns the cached result for ip. A missing or expired one is
+// looked up in background, so DNS never delays a request: until the lookup
+// finishes requests of the crawler get the expired result or are not
+// verified.
+func (bc *BotClassifier) verified(ip net.IP, r botRule) bool {
+	key := r.name + "|" + ip.String()
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	v, ok := bc.cache.get(key)
+	if ok && time.Now().Before(v.expires) {
+		return v.ok
+	}
+	if !bc.closed && !bc.pending[key] && len(bc.pending) < maxBotLookups {
+		bc.pending[key] = true
+		bc.lookups.Add(1)
+		go bc.confirm(key, ip, r.domains)
+	}
+	return v.ok
+}
+
+func (bc *BotClassifier) confirm(key string, ip net.IP, domains []string) {
+	defer bc.lookups.Done()
+	ttl := bc.cacheTTL
+	res, err := bc.lookup(ip, domains)
+	if err != nil {
+		// DNS failures and timeouts are remembered for a shorter time
+		ttl = bc.failureTTL
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	delete(bc.pending, key)
+	bc.cache.add(key, botVerification{ok: res, expires: time.Now().Add(ttl)})
+}
+
+// lookup implements forward-confirmed reverse DNS: PTR of ip must be inside
+// one of the domains and resolve back to the same ip
+func (bc *BotClassifier) lookup(ip net.IP, domains []string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), bc.timeout)
+	defer cancel()
+	names, err := bc.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, name := range names {
+		host := strings.TrimSuffix(strings.ToLower(name), ".")
+		if !hostInDomains(host, domains) {
+			continue
+		}
+		addrs, err := bc.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func hostInDomains(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bc *BotClassifier) hosting(ip net.IP) (string, bool) {
+	if bc.asn == nil || ip == nil {
+		return "", false
+	}
+	rec, err := bc.asn.ASN(ip)
+	if err != nil || rec.AutonomousSystemNumber == 0 {
+		return "", false
+	}
+	if bc.hostingASNs[rec.AutonomousSystemNumber] {
+		return rec.AutonomousSystemOrganization, true
+	}
+	org := strings.ToLower(rec.AutonomousSystemOrganization)
+	for _, h := range bc.hostingOrgs {
+		if strings.Contains(org, h) {
+			return rec.AutonomousSystemOrganization, true
+		}
+	}
+	return "", false
+}
+
+// Close waits for lookups in progress and releases the ASN database
+func (bc *BotClassifier) Close() error {
+	if bc == nil {
+		return nil
+	}
+	bc.mu.Lock()
+	bc.closed = true
+	bc.mu.Unlock()
+	bc.lookups.Wait()
+	if bc.asn == nil {
+		return nil
+	}
+	return bc.asn.Close()
+}
+
+// closeLater closes a classifier replaced by Reload once requests which took
+// it before are done with it
+func (bc *BotClassifier) closeLater() {
+	if bc != nil {
+		time.AfterFunc(replacedBotClassifierTTL, func() { bc.Close() })
+	}
+}
+
+// parseIP accepts bare addresses, host:port pairs and X-Forwarded-For lists
+func parseIP(addr string) net.IP {
+	addr = strings.TrimSpace(strings.Split(addr, ",")[0])
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+func (ar *AccessRecord) fillBot(b BotInfo) {
+	ar.IsBot = b.IsBot
+	ar.BotName = b.Name
+	ar.BotVerified = b.Verified
+	ar.HostingOrg = b.HostingOrg
+}
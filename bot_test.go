@@ -0,0 +1,168 @@
+package ECMSLogger
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResolver answers from maps and counts lookups
+type stubResolver struct {
+	mu      sync.Mutex
+	ptr     map[string][]string
+	hosts   map[string][]string
+	fail    bool
+	lookups int
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if r.fail {
+		return nil, errors.New("i/o timeout")
+	}
+	names, ok := r.ptr[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := []net.IPAddr{}
+	for _, a := range r.hosts[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(a)})
+	}
+	return addrs, nil
+}
+
+const googlebotUA = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+
+func TestBotVerification(t *testing.T) {
+	resolver := &stubResolver{
+		ptr: map[string][]string{
+			"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."},
+			// PTR is controlled by the owner of the network
+			"203.0.113.5": {"crawl-203-0-113-5.googlebot.com."},
+			"203.0.113.6": {"fake.example.com."},
+		},
+		hosts: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"},
+			"crawl-203-0-113-5.googlebot.com": {"66.249.66.5"},
+		},
+	}
+	bc, err := NewBotClassifier(&Bots{Verify: true}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	tests := []struct {
+		ip       string
+		verified bool
+	}{
+		{"66.249.66.1", true},
+		// forward lookup does not confirm the PTR
+		{"203.0.113.5", false},
+		// PTR outside of Google domains
+		{"203.0.113.6", false},
+		// no PTR
+		{"198.51.100.7", false},
+	}
+	// the first request starts the lookup and is not verified yet
+	for _, tt := range tests {
+		if res := bc.Classify(googlebotUA, net.ParseIP(tt.ip), UAInfo{}); res.Verified {
+			t.Errorf("%s: verified before lookup", tt.ip)
+		}
+	}
+	bc.lookups.Wait()
+	for _, tt := range tests {
+		res := bc.Classify(googlebotUA, net.ParseIP(tt.ip), UAInfo{})
+		if !res.IsBot || res.Name != "Googlebot" || res.Verified != tt.verified {
+			t.Errorf("%s: %+v", tt.ip, res)
+		}
+	}
+	// results are cached
+	lookups := resolver.lookups
+	bc.Classify(googlebotUA, net.ParseIP("66.249.66.1"), UAInfo{})
+	bc.Classify(googlebotUA, net.ParseIP("203.0.113.5"), UAInfo{})
+	bc.lookups.Wait()
+	if resolver.lookups != lookups {
+		t.Errorf("%d lookups for cached results", resolver.lookups-lookups)
+	}
+}
+
+func TestBotVerificationFailure(t *testing.T) {
+	resolver := &stubResolver{fail: true}
+	bc, err := NewBotClassifier(&Bots{Verify: true}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	for i := 0; i < 3; i++ {
+		res := bc.Classify(googlebotUA, net.ParseIP("66.249.66.1"), UAInfo{})
+		if !res.IsBot || res.Verified {
+			t.Errorf("%+v", res)
+		}
+		bc.lookups.Wait()
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("failed lookup is repeated %d times", resolver.lookups)
+	}
+	// after failureTTL the lookup is retried
+	for _, e := range bc.cache.items {
+		entry := e.Value.(*botCacheEntry)
+		if entry.v.expires.Sub(time.Now()) > defaultBotFailureTTL {
+			t.Errorf("failure is cached until %s", entry.v.expires)
+		}
+		entry.v.expires = time.Now()
+	}
+	resolver.fail = false
+	bc.Classify(googlebotUA, net.ParseIP("66.249.66.1"), UAInfo{})
+	bc.lookups.Wait()
+	if resolver.lookups != 2 {
+		t.Errorf("%d lookups", resolver.lookups)
+	}
+}
+
+func TestBotEmptyUserAgent(t *testing.T) {
+	bc, err := NewBotClassifier(&Bots{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	for _, tt := range []struct {
+		ua   string
+		info UAInfo
+		bot  string
+	}{
+		{"", UAInfo{}, ""},
+		{"curl/8.4.0", UAInfo{}, "curl"},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", UAInfo{}, ""},
+		{"SomeSpider/1.0", UAInfo{IsBot: true, Browser: "SomeSpider"}, "SomeSpider"},
+	} {
+		res := bc.Classify(tt.ua, nil, tt.info)
+		if res.IsBot != (tt.bot != "") || res.Name != tt.bot {
+			t.Errorf("%q: %+v", tt.ua, res)
+		}
+	}
+}
+
+func TestBotCacheEviction(t *testing.T) {
+	c := newBotCache(2)
+	c.add("a", botVerification{ok: true})
+	c.add("b", botVerification{ok: true})
+	// a is used, so b is the least recently used
+	c.get("a")
+	c.add("c", botVerification{ok: true})
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != kept {
+			t.Errorf("%s kept: %v", key, ok)
+		}
+	}
+}
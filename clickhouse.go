@@ -1,206 +1,471 @@
 package ECMSLogger
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Logger struct {
-	chWriter        *sqlx.DB
-	chInsertQuery   string
-	logTable        string
-	availableFields []string
+	// unix nanoseconds, first for atomic alignment
+	lastFlush     int64
+	conf          *ClickhouseSettings
+	chInsertQuery string
+	logTable      string
+	records       chan AccessRecord
+	// nil when reserve is not configured
+	reserve *reserveWriter
+	metrics *Metrics
+	// messages of several loggers in one process differ by table
+	log *log.Entry
+	// guards chWriter which is set by the background connection
+	mu       sync.Mutex
+	chWriter *sqlx.DB
+	// guards records against sending after Close
+	closeMu  sync.RWMutex
+	closed   bool
+	batching chan batching
+	stop     chan struct{}
+	done     chan struct{}
 }
 
-var records chan AccessRecord
+const maxConnectDelay = 30 * time.Second
 
-func formConnectionString(c *Connection) string {
-	address_template := "tcp://%s:%d?username=%s&password=%s&database=%s&write_timeout=%d&debug=%v"
-	address := fmt.Sprintf(address_template, c.Host, c.Port, c.User, c.Password, c.DB, c.Timeout.Seconds(), c.Debug)
-	if len(c.AltHosts) > 0 {
-		address += ("&alt_hosts=" + strings.Join(c.AltHosts, ","))
+var errNotConnected = errors.New("clickhouse is not connected yet")
+
+// tableColumns of the log table. Tables created by older versions get the
+// missing ones from Migrate.
+var tableColumns = []struct {
+	name string
+	typ  string
+}{
+	{"time", "DateTime"},
+	{"client_time", "DateTime"},
+	{"kind", "LowCardinality(String)"},
+	{"request_id", "String"},
+	{"trace_id", "FixedString(32)"},
+	{"span_id", "FixedString(16)"},
+	{"parent_span_id", "String"},
+	{"trace_state", "String"},
+	{"region", "String"},
+	{"location", "String"},
+	{"host", "String"},
+	{"method", "String"},
+	{"request_uri", "String"},
+	{"version", "String"},
+	{"category", "String"},
+	{"subject", "String"},
+	{"remote_addr", "FixedString(16)"},
+	{"content_length", "Int64"},
+	{"os", "String"},
+	{"os_version", "String"},
+	{"browser", "String"},
+	{"browser_version", "String"},
+	{"device_type", "LowCardinality(String)"},
+	{"is_bot", "UInt8"},
+	{"bot_name", "LowCardinality(String)"},
+	{"bot_verified", "UInt8"},
+	{"hosting_org", "LowCardinality(String)"},
+	{"continent", "String"},
+	{"country", "String"},
+	{"iso_country", "String"},
+	{"city", "String"},
+	{"subdivision", "String"},
+	{"timezone", "String"},
+	{"duration_us", "UInt64"},
+	{"redis_duration_us", "UInt64"},
+	{"db_duration_us", "UInt64"},
+	{"db_queries", "UInt32"},
+	{"db_slowest_us", "UInt64"},
+	{"db_slowest_query", "String"},
+	{"redis_calls", "UInt32"},
+	{"longitude", "Float64"},
+	{"latitude", "Float64"},
+	{"accuracy_radius", "UInt16"},
+	{"eu_member", "UInt8"},
+	{"width", "UInt32"},
+	{"height", "UInt32"},
+	{"user", "String"},
+	{"user_agent", "String"},
+	{"source", "Nullable(String)"},
+	{"target", "Nullable(String)"},
+	{"params", "Nullable(String)"},
+	{"status", "UInt16"},
+	{"response", "Nullable(String)"},
+	{"response_length", "UInt64"},
+	{"error", "Nullable(String)"},
+	{"rpc_code", "LowCardinality(String)"},
+	{"request_messages", "UInt32"},
+	{"response_messages", "UInt32"},
+	{"sample_rate", "Float64"},
+	{"branch", "String"},
+	{"commit_hash", "FixedString(40)"},
+	{"tag", "String"},
+	{"client_name", "String"},
+	{"client_branch", "String"},
+	{"client_commit_hash", "FixedString(40)"},
+	{"client_tag", "String"},
+	{"request_headers", "Map(String, String)"},
+	{"response_headers", "Map(String, String)"},
+}
+
+func createTableQuery(table string) string {
+	defs := make([]string, len(tableColumns))
+	for i, c := range tableColumns {
+		defs[i] = "\t" + c.name + " " + c.typ
 	}
-	return address
+	return "CREATE TABLE IF NOT EXISTS " + table + " (\n" + strings.Join(defs, ",\n") +
+		"\n) engine=MergeTree() ORDER BY time PARTITION BY toYYYYMM(time)"
 }
 
-func (l *Logger) Init(cs *ClickhouseSettings) {
-	if cs.Reserve != nil {
-		maxSize = ParseSize(cs.Reserve.Rotate.MaxSize)
-		if maxSize == 0 {
-			panic("Wrong maxSize")
-		}
-		if err := CheckTouch(cs.Reserve.Dir); err != nil {
-			panic("Cannot touch in " + cs.Reserve.Dir + ": " + err.Error())
+// MigrationQueries creates the table or adds columns missing in it
+func MigrationQueries(table string) []string {
+	queries := []string{createTableQuery(table)}
+	for i, c := range tableColumns[1:] {
+		queries = append(queries, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s AFTER %s",
+			table, c.name, c.typ, tableColumns[i].name))
+	}
+	return queries
+}
+
+// Migrate runs MigrationQueries
+func Migrate(ctx context.Context, db *sqlx.DB, table string) error {
+	if !identifierRegex.MatchString(table) {
+		return errors.New("Wrong log table name: " + table)
+	}
+	for _, q := range MigrationQueries(table) {
+		if _, err := db.ExecContext(ctx, q); err != nil {
+			return err
 		}
 	}
-	l.logTable = cs.Table
-	if l.logTable == "" {
-		panic("Log table has empty name")
+	return nil
+}
+
+// OpenClickhouse opens a connection pool with limits from c, it does not
+// connect until the first query
+func OpenClickhouse(c *Connection) (*sqlx.DB, error) {
+	conn := sqlx.NewDb(clickhouse.OpenDB(clickhouseOptions(c)), "clickhouse")
+	if c.IdleLimit != 0 {
+		conn.SetMaxIdleConns(c.IdleLimit)
 	}
-	address := formConnectionString(&cs.Connection)
-	conn, err := sqlx.Open("clickhouse", address)
-	if err != nil {
-		panic("failed to open clickhouse database on read: " + err.Error())
+	if c.ConnLimit != 0 {
+		conn.SetMaxOpenConns(c.ConnLimit)
+	}
+	return conn, nil
+}
+
+// clickhouseOptions passes credentials as they are, so a password may
+// contain any characters
+func clickhouseOptions(c *Connection) *clickhouse.Options {
+	return &clickhouse.Options{
+		Addr: append([]string{net.JoinHostPort(c.Host, c.Port)}, c.AltHosts...),
+		Auth: clickhouse.Auth{
+			Database: c.DB,
+			Username: c.User,
+			Password: c.Password,
+		},
+		DialTimeout: c.Timeout,
+		Debug:       c.Debug,
+	}
+}
+
+// NewLogger fills defaults of settings, checks them and starts the writer.
+// It does not wait for ClickHouse: the connection is made in background and
+// until it succeeds batches go to the reserve dir.
+func NewLogger(cs *ClickhouseSettings) (*Logger, error) {
+	errs := ValidationErrors{}
+	cs.validate(&errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	l := &Logger{
+		conf:     cs,
+		logTable: cs.Table,
+		batching: make(chan batching, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		log:      log.WithField("table", cs.Table),
+	}
+	if cs.Reserve != nil {
+		w, err := newReserveWriter(cs.Reserve, l.log)
+		if err != nil {
+			return nil, err
+		}
+		l.reserve = w
 	}
-	i := 1
-	for i < 10 {
-		err = conn.Ping()
+	l.chInsertQuery = insertQuery(l.logTable)
+	l.records = make(chan AccessRecord, cs.MaxQueueSize)
+	l.metrics = newMetrics(l)
+	if l.reserve != nil {
+		l.reserve.metrics = l.metrics
+	}
+	l.markFlushed()
+	go l.connect()
+	go l.send()
+	return l, nil
+}
+
+// connect retries with growing delay until ClickHouse answers or the logger
+// is closed
+func (l *Logger) connect() {
+	delay := time.Second
+	for {
+		err := l.tryConnect()
 		if err == nil {
-			break
-		} else {
-			if cs.Connection.Debug {
-				log.Info("clickhouse database is not ready. waiting...")
-			}
-			time.Sleep(time.Duration(i) * time.Second)
+			return
 		}
-		i += 1
-	}
-	if i >= 10 {
-		panic("Clickhouse cannot ping: " + err.Error())
-	}
-	if cs.Connection.IdleLimit != 0 {
-		conn.SetMaxIdleConns(cs.Connection.IdleLimit)
-	}
-	if cs.Connection.ConnLimit != 0 {
-		conn.SetMaxOpenConns(cs.Connection.ConnLimit)
-	}
-	_, err = l.chWriter.Exec(`
-		CREATE TABLE IF NOT EXISTS ` + l.logTable + ` (
-			time			   DateTime,
-			client_time	  	   DateTime,
-			region			   String,
-			location		   String,
-			host			   String,
-			method			   String,
-			request_uri		   String,
-			version			   String,
-			category		   String,
-			subject			   String,
-			remote_addr		   FixedString(16),
-			content_length	   Int64,
-			os				   String,
-			browser			   String,
-			continent		   String,
-			country			   String,
-			iso_country		   String,
-			city			   String,
-			subdivision		   String,
-			timezone		   String,
-			duration_us		   UInt64,
-			redis_duration_us  UInt64,
-			db_duration_us	   UInt64,
-			longitude		   Float64,
-			latitude		   Float64,
-			accuracy_radius	   UInt16,
-			eu_member		   UInt8,
-			width			   UInt32,
-			height			   UInt32,
-			user			   String,
-			user_agent		   String,
-			source			   Nullable(String),
-			target			   Nullable(String),
-			params			   Nullable(String),
-			status			   UInt16,
-			response		   Nullable(String),
-			response_length	   UInt64,
-			error			   Nullable(String),
-			branch			   String,
-			commit_hash		   FixedString(40),
-			tag				   String,
-			client_name		   String,
-			client_branch	   String,
-			client_commit_hash FixedString(40),
-			client_tag		   String
-		) engine=MergeTree() ORDER BY time PARTITION BY toYYYYMM(time)
-	`)
+		l.log.Warning("Clickhouse is not available, retry in ", delay, ": ", err)
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+	}
+}
+
+func (l *Logger) tryConnect() error {
+	cs := l.conf
+	conn, err := OpenClickhouse(&cs.Connection)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	lr := AccessRecord{}
-	l.availableFields = lr.GetAvailableFields()
-	f := strings.Join(l.availableFields, ", ")
-	placeholders := ":" + strings.Join(l.availableFields, ", :")
-	queryTempl := "INSERT INTO %s (%s) VALUES (%s)"
-	l.chInsertQuery = fmt.Sprintf(queryTempl, l.logTable, f, placeholders)
-	records = make(chan AccessRecord, cs.MaxQueueSize)
-	go l.send(cs)
+	timeout := cs.Connection.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err = conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return err
+	}
+	// tables created by older versions lack new columns which inserts name.
+	// Inserts into an up to date table work without ALTER rights, so a
+	// failed migration does not stop the logger.
+	if cs.Migrate {
+		if err := Migrate(ctx, conn, l.logTable); err != nil {
+			l.log.Error("Cannot migrate the table: ", err)
+		}
+	}
+	l.mu.Lock()
+	l.chWriter = conn
+	l.mu.Unlock()
+	if cs.Connection.Debug {
+		l.log.Info("Clickhouse is connected")
+	}
+	return nil
 }
 
-func StopLogging() {
-	close(records)
+func (l *Logger) db() *sqlx.DB {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.chWriter
 }
 
-func (l *Logger) send(cs *ClickhouseSettings) {
-	logStorage := make([]AccessRecord, 0, cs.MaxQueueSize)
+// Connected reports whether the background connection has succeeded
+func (l *Logger) Connected() bool {
+	return l.db() != nil
+}
+
+// Send queues the record. It blocks while the queue is full and drops the
+// record after Close.
+func (l *Logger) Send(ar AccessRecord) {
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		l.metrics.observeDropped("closed", 1)
+		return
+	}
+	l.records <- ar
+}
+
+// Close flushes queued records and closes the connection
+func (l *Logger) Close() error {
+	l.closeMu.Lock()
+	if l.closed {
+		l.closeMu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.stop)
+	close(l.records)
+	l.closeMu.Unlock()
+	<-l.done
+	l.reserve.close()
+	if db := l.db(); db != nil {
+		return db.Close()
+	}
+	return nil
+}
+
+type batching struct {
+	size   int
+	period time.Duration
+}
+
+// SetBatching changes batch size and flush period of the running logger. It
+// does not wait for a flush in progress: the writer picks the latest values
+// up when it is done.
+func (l *Logger) SetBatching(size int, period time.Duration) {
+	l.closeMu.RLock()
+	defer l.closeMu.RUnlock()
+	if l.closed {
+		return
+	}
+	for {
+		select {
+		case l.batching <- batching{size, period}:
+			return
+		default:
+		}
+		// replace values the writer has not taken yet
+		select {
+		case <-l.batching:
+		default:
+		}
+	}
+}
+
+func (l *Logger) send() {
+	defer close(l.done)
+	cs := l.conf
+	b := batching{cs.BatchSize, cs.Period}
+	logStorage := make([]AccessRecord, 0, b.size+1)
 	var ticker *time.Ticker
-	if cs.Period.Seconds() != 0 {
-		ticker = time.NewTicker(cs.Period)
+	var tick <-chan time.Time
+	resetTicker := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if b.period > 0 {
+			ticker = time.NewTicker(b.period)
+			tick = ticker.C
+		}
 	}
+	resetTicker()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
 	for {
-		log.Debug("Waiting message")
+		l.log.Debug("Waiting message")
 		select {
-		case r, ok := <-records:
+		case r, ok := <-l.records:
 			if !ok {
 				if cs.Connection.Debug {
-					log.Debug("Channel is closed. Flushing")
-				}
-				err := l.flush(logStorage)
-				if err != nil {
-					log.Error(err)
-					reserveRecords(logStorage, cs.Reserve)
+					l.log.Debug("Channel is closed. Flushing")
 				}
-				logStorage = logStorage[:0]
+				l.flushOrReserve(logStorage, true)
+				return
 			}
 			logStorage = append(logStorage, r)
-			if len(logStorage) > cs.BatchSize {
+			if len(logStorage) > b.size {
 				if cs.Connection.Debug {
-					log.Debug("Long queue. Flushing")
-				}
-				err := l.flush(logStorage)
-				if err != nil {
-					log.Error(err)
-				} else {
-					logStorage = logStorage[:0]
+					l.log.Debug("Long queue. Flushing")
 				}
+				logStorage = l.flushOrReserve(logStorage, false)
 			}
-		case <-ticker.C:
+		case <-tick:
 			if cs.Connection.Debug {
-				log.Debug("Time is up. Flushing")
+				l.log.Debug("Time is up. Flushing")
+			}
+			logStorage = l.flushOrReserve(logStorage, false)
+		case nb := <-l.batching:
+			if nb.period != b.period {
+				b.period = nb.period
+				resetTicker()
 			}
-			err := l.flush(logStorage)
-			if err != nil {
-				log.Error(err)
-			} else {
-				logStorage = logStorage[:0]
+			b.size = nb.size
+			if len(logStorage) > b.size {
+				logStorage = l.flushOrReserve(logStorage, false)
 			}
 		}
 	}
 }
 
-func (l *Logger) flush(logStorage []AccessRecord) error {
-	localRecords := append(make([]AccessRecord, 0, len(logStorage)), logStorage...)
-	tx, err := l.chWriter.Beginx()
+// flushOrReserve writes the batch to ClickHouse or, when it fails, to the
+// reserve dir. Without reserve dir the batch is kept for the next attempt
+// until it grows to maxQueueSize.
+func (l *Logger) flushOrReserve(logStorage []AccessRecord, final bool) []AccessRecord {
+	if len(logStorage) == 0 {
+		// nothing is pending, an idle logger is as fresh as its connection
+		if l.Connected() {
+			l.markFlushed()
+		}
+		return logStorage
+	}
+	err := errNotConnected
+	if l.Connected() {
+		err = l.flush(logStorage)
+		if err != nil {
+			l.log.Error(err)
+		}
+	}
+	if err == nil {
+		return logStorage[:0]
+	}
+	if l.reserve == nil && !final && len(logStorage) < l.conf.MaxQueueSize {
+		return logStorage
+	}
+	l.reserveRecords(logStorage)
+	return logStorage[:0]
+}
+
+func insertQuery(table string) string {
+	lr := AccessRecord{}
+	fields := lr.GetAvailableFields()
+	f := strings.Join(fields, ", ")
+	placeholders := ":" + strings.Join(fields, ", :")
+	queryTempl := "INSERT INTO %s (%s) VALUES (%s)"
+	return fmt.Sprintf(queryTempl, table, f, placeholders)
+}
+
+func (l *Logger) flush(logStorage []AccessRecord) (err error) {
+	defer func(start time.Time) {
+		l.metrics.observeFlush(len(logStorage), time.Since(start), err)
+	}(time.Now())
+	err = insertRecords(l.db(), l.chInsertQuery, logStorage)
 	if err != nil {
 		return err
 	}
-	nstmt, err := tx.PrepareNamed(l.chInsertQuery)
+	l.markFlushed()
+	return nil
+}
+
+// InsertRecords writes records to table in one transaction, e.g. to replay
+// the reserve dir
+func InsertRecords(db *sqlx.DB, table string, records []AccessRecord) error {
+	return insertRecords(db, insertQuery(table), records)
+}
+
+func insertRecords(db *sqlx.DB, query string, logStorage []AccessRecord) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	nstmt, err := tx.PrepareNamed(query)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	for _, r := range localRecords {
+	for _, r := range logStorage {
 		_, err = nstmt.Exec(r)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-	return nil
+	return tx.Commit()
 }
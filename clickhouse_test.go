@@ -0,0 +1,60 @@
+package ECMSLogger
+
+import (
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClickhouseOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		conn Connection
+		addr []string
+		auth clickhouse.Auth
+	}{
+		{
+			name: "plain",
+			conn: Connection{Host: "localhost", Port: "9000", User: "default", DB: "logs", Timeout: 10 * time.Second},
+			addr: []string{"localhost:9000"},
+			auth: clickhouse.Auth{Database: "logs", Username: "default"},
+		},
+		{
+			name: "special characters",
+			conn: Connection{Host: "ch", Port: "9000", User: "a&b=c", Password: "p@ss#w?rd&x=1 %20+", DB: "logs"},
+			addr: []string{"ch:9000"},
+			auth: clickhouse.Auth{Database: "logs", Username: "a&b=c", Password: "p@ss#w?rd&x=1 %20+"},
+		},
+		{
+			name: "alt hosts",
+			conn: Connection{Host: "::1", Port: "9000", AltHosts: []string{"ch2:9000", "[::2]:9000"}, Debug: true},
+			addr: []string{"[::1]:9000", "ch2:9000", "[::2]:9000"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := clickhouseOptions(&tc.conn)
+			if !reflect.DeepEqual(o.Addr, tc.addr) || o.Auth != tc.auth {
+				t.Errorf("address %v, auth %+v", o.Addr, o.Auth)
+			}
+			if o.DialTimeout != tc.conn.Timeout || o.Debug != tc.conn.Debug {
+				t.Errorf("timeout %s, debug %v", o.DialTimeout, o.Debug)
+			}
+		})
+	}
+}
+
+func TestNewLoggerDefaults(t *testing.T) {
+	cs := &ClickhouseSettings{Table: "access", Connection: Connection{Port: "1"}}
+	l, err := NewLogger(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if cs.BatchSize != DefaultBatchSize || cs.Period != DefaultPeriod || cap(l.records) != DefaultMaxQueueSize {
+		t.Errorf("batch %d, period %s, queue %d", cs.BatchSize, cs.Period, cap(l.records))
+	}
+	if _, err := NewLogger(&ClickhouseSettings{Table: "access; drop"}); err == nil {
+		t.Error("wrong table name is accepted")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	ECMSLogger "github.com/aido93/ecms-logger"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func migrate(configFile string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print queries without running them")
+	fs.Parse(args)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	table := config.Clickhouse.Table
+	if *dryRun {
+		for _, q := range ECMSLogger.MigrationQueries(table) {
+			fmt.Println(q + ";")
+		}
+		return nil
+	}
+	db, err := connect(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := ECMSLogger.Migrate(context.Background(), db, table); err != nil {
+		return err
+	}
+	fmt.Println("table", table, "is up to date")
+	return nil
+}
+
+// progressExt is the suffix of a file next to a reserve file which keeps the
+// number of its records written by an interrupted replay
+const progressExt = ".replayed"
+
+// readProgress returns the number of records of file written before, 0 when
+// there is no progress file
+func readProgress(file string) (int, error) {
+	b, err := ioutil.ReadFile(file + progressExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+func writeProgress(file string, n int) error {
+	return ioutil.WriteFile(file+progressExt, []byte(strconv.Itoa(n)+"\n"), 0644)
+}
+
+// replay inserts reserve files the oldest first, or produces them to Kafka
+// with -kafka. A file is deleted after all its records are written, files
+// with corrupted blocks are renamed to *.corrupt instead. A failed write
+// stops the replay and the number of records written from the file is saved
+// next to it, so the next run continues from the failed batch. Only a batch
+// which was written but not counted because of a crash is written twice.
+func replay(configFile string, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	keep := fs.Bool("keep", false, "do not delete replayed files")
+	batch := fs.Int("batch", 0, "records per insert or produce, batchSize of the target by default")
+	kafka := fs.Bool("kafka", false, "produce to the topic of the Kafka sink instead of inserting, the Kafka reserve is the default dir")
+	fs.Parse(args)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	reserve := configuredReserve(config, *kafka)
+	dir := fs.Arg(0)
+	if dir == "" {
+		if reserve == nil {
+			return errors.New("reserve is not configured, pass the dir")
+		}
+		dir = reserve.Dir
+	}
+	if *batch == 0 {
+		*batch = config.Clickhouse.BatchSize
+		if *kafka && config.Sinks.Kafka != nil {
+			*batch = config.Sinks.Kafka.BatchSize
+		}
+	}
+	if *batch <= 0 {
+		return errors.New("batch must be positive")
+	}
+	files, err := ECMSLogger.ReserveFiles(dir)
+	if err != nil {
+		return err
+	}
+	keys, err := reserveKeys(reserve)
+	if err != nil {
+		return err
+	}
+	var write func(records []ECMSLogger.AccessRecord) error
+	if *kafka {
+		if config.Sinks.Kafka == nil {
+			return errors.New("kafka sink is not configured")
+		}
+		write = func(records []ECMSLogger.AccessRecord) error {
+			return ECMSLogger.ProduceRecords(config.Sinks.Kafka, records)
+		}
+	} else {
+		db, err := connect(config)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		write = func(records []ECMSLogger.AccessRecord) error {
+			return ECMSLogger.InsertRecords(db, config.Clickhouse.Table, records)
+		}
+	}
+	total := 0
+	for _, f := range files {
+		rf, err := ECMSLogger.ReadReserveFile(f, keys)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "skipped:", err)
+			continue
+		}
+		printCorrupt(rf)
+		records := rf.Records
+		// -keep replays files again on every run
+		done := 0
+		if !*keep {
+			if done, err = readProgress(f); err != nil {
+				return fmt.Errorf("%s: %v", f+progressExt, err)
+			}
+		}
+		if done > len(records) {
+			done = len(records)
+		}
+		for start := done; start < len(records); start += *batch {
+			end := start + *batch
+			if end > len(records) {
+				end = len(records)
+			}
+			if err := write(records[start:end]); err != nil {
+				return fmt.Errorf("%s: %d of %d records replayed: %v", f, start, len(records), err)
+			}
+			if !*keep && end < len(records) {
+				if err := writeProgress(f, end); err != nil {
+					return err
+				}
+			}
+		}
+		total += len(records) - done
+		fmt.Printf("%s: %d records\n", f, len(records)-done)
+		switch {
+		case *keep:
+		case len(rf.Corrupt) > 0:
+			err = os.Rename(f, f+".corrupt")
+		default:
+			err = os.Remove(f)
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(f + progressExt); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fmt.Printf("replayed %d records from %d files\n", total, len(files))
+	return nil
+}
+
+// tail prints records as JSON lines, the oldest first
+func tail(configFile string, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	n := fs.Int("n", 20, "number of records")
+	follow := fs.Bool("f", false, "keep printing new records")
+	interval := fs.Duration("interval", 2*time.Second, "poll interval with -f")
+	where := fs.String("where", "", "SQL condition, e.g. \"status >= 500\"")
+	fs.Parse(args)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	db, err := connect(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ar := ECMSLogger.AccessRecord{}
+	fields := strings.Join(ar.GetAvailableFields(), ", ")
+	cond := "1"
+	if *where != "" {
+		cond = "(" + *where + ")"
+	}
+	records := []ECMSLogger.AccessRecord{}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY time DESC LIMIT %d", fields, config.Clickhouse.Table, cond, *n)
+	if err := db.Select(&records, query); err != nil {
+		return err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		printRecord(records[i])
+	}
+	if !*follow {
+		return nil
+	}
+	last := time.Now()
+	if len(records) > 0 {
+		last = records[0].Time
+	}
+	seen := spansAt(records, last)
+	query = fmt.Sprintf("SELECT %s FROM %s WHERE %s AND time >= ? ORDER BY time LIMIT 10000", fields, config.Clickhouse.Table, cond)
+	for {
+		time.Sleep(*interval)
+		records = records[:0]
+		if err := db.Select(&records, query, last); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r.Time.Equal(last) && seen[r.SpanID] {
+				continue
+			}
+			printRecord(r)
+		}
+		if len(records) > 0 {
+			if t := records[len(records)-1].Time; t.After(last) {
+				last = t
+				seen = map[string]bool{}
+			}
+			for k := range spansAt(records, last) {
+				seen[k] = true
+			}
+		}
+	}
+}
+
+// spansAt collects span ids of records within the last second, DateTime
+// has no fractions, so they are selected again by the next poll
+func spansAt(records []ECMSLogger.AccessRecord, t time.Time) map[string]bool {
+	res := map[string]bool{}
+	for _, r := range records {
+		if r.Time.Equal(t) {
+			res[r.SpanID] = true
+		}
+	}
+	return res
+}
+
+func printRecord(r ECMSLogger.AccessRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Println(string(b))
+}
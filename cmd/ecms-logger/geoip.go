@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	ECMSLogger "github.com/aido93/ecms-logger"
+	"github.com/oschwald/geoip2-golang"
+	"os"
+	"time"
+)
+
+type geoResult struct {
+	IP                string  `json:"ip"`
+	Continent         string  `json:"continent"`
+	Country           string  `json:"country"`
+	IsoCountry        string  `json:"isoCountry"`
+	Subdivision       string  `json:"subdivision"`
+	City              string  `json:"city"`
+	Latitude          float64 `json:"latitude"`
+	Longitude         float64 `json:"longitude"`
+	AccuracyRadius    uint16  `json:"accuracyRadius"`
+	Timezone          string  `json:"timezone"`
+	IsInEuropeanUnion bool    `json:"euMember"`
+	ClientTime        string  `json:"clientTime"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// geoip fills the same fields as the middleware does for each ip
+func geoip(configFile string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("pass at least one ip")
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	db, err := geoip2.Open(config.MaxMind.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	meta := db.Metadata()
+	built := time.Unix(int64(meta.BuildEpoch), 0).UTC()
+	fmt.Fprintf(os.Stderr, "%s: %s built %s\n", config.MaxMind.DB, meta.DatabaseType, built.Format(time.RFC3339))
+	failed := 0
+	for _, ip := range args {
+		ar := ECMSLogger.AccessRecord{Time: time.Now()}
+		res := geoResult{IP: ip}
+		if err := ar.FillGeo(db, ip); err != nil {
+			res.Error = err.Error()
+			failed++
+		} else {
+			res.Continent = ar.Continent
+			res.Country = ar.Country
+			res.IsoCountry = ar.IsoCountry
+			res.Subdivision = ar.Subdivision
+			res.City = ar.City
+			res.Latitude = ar.Latitude
+			res.Longitude = ar.Longitude
+			res.AccuracyRadius = ar.AccuracyRadius
+			res.Timezone = ar.Timezone
+			res.IsInEuropeanUnion = ar.IsInEuropeanUnion
+			res.ClientTime = ar.ClientTime.Format(time.RFC3339)
+		}
+		b, _ := json.Marshal(res)
+		fmt.Println(string(b))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d lookups failed", failed, len(args))
+	}
+	return nil
+}
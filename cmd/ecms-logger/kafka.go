@@ -0,0 +1,12 @@
+package main
+
+import (
+	"fmt"
+	ECMSLogger "github.com/aido93/ecms-logger"
+)
+
+// proto prints the protobuf schema of Kafka messages
+func proto(configFile string, args []string) error {
+	_, err := fmt.Print(ECMSLogger.KafkaProtoSchema())
+	return err
+}
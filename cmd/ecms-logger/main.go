@@ -0,0 +1,159 @@
+// Command ecms-logger operates the access logger: checks configs, migrates
+// the log table, replays and inspects reserve files, tails recent records,
+// tests GeoIP enrichment and prints the Kafka message schema.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	ECMSLogger "github.com/aido93/ecms-logger"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+)
+
+const usage = `Usage: ecms-logger [-config logger.yaml] <command> [flags] [args]
+
+Commands:
+  validate [-paths] [-print]         check config, print it with defaults applied
+  migrate [-dry-run]                 create the table or add missing columns
+  replay [-keep] [-batch n] [-kafka] [dir]
+                                     insert reserve files into ClickHouse or produce
+                                     them to Kafka and delete them
+  inspect [-records] [-kafka] [file|dir]
+                                     show reserve files and their records
+  tail [-n 20] [-f] [-where cond]    print recent records from ClickHouse
+  geoip <ip>...                      look ip up in the configured MaxMind database
+  proto                              print the protobuf schema of Kafka messages
+
+Flags:
+`
+
+// command gets the config path, the commands which need the config read it
+// with loadConfig after parsing their flags
+type command func(configFile string, args []string) error
+
+var commands = map[string]command{
+	"validate": validate,
+	"migrate":  migrate,
+	"replay":   replay,
+	"inspect":  inspect,
+	"tail":     tail,
+	"geoip":    geoip,
+	"proto":    proto,
+}
+
+func main() {
+	defaultConfig := os.Getenv("ECMS_LOGGER_CONFIG")
+	if defaultConfig == "" {
+		defaultConfig = "logger.yaml"
+	}
+	configFile := flag.String("config", defaultConfig, "logger config, $ECMS_LOGGER_CONFIG by default")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name := flag.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "ecms-logger: unknown command %q, use one of %v\n", name, names)
+		os.Exit(2)
+	}
+	if err := cmd(*configFile, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ecms-logger %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func loadConfig(configFile string) (*ECMSLogger.Config, error) {
+	config, err := ECMSLogger.ReadConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", configFile, err)
+	}
+	return &config, nil
+}
+
+// validate has nothing to do beyond loadConfig unless flags are set
+func validate(configFile string, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	printConfig := fs.Bool("print", false, "print config with defaults, secrets are masked")
+	checkPaths := fs.Bool("paths", false, "check that files and dirs of the config exist")
+	fs.Parse(args)
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if *checkPaths {
+		if err := config.CheckPaths(); err != nil {
+			return err
+		}
+	}
+	if !*printConfig {
+		fmt.Println("config is valid")
+		return nil
+	}
+	masked := *config
+	if masked.Clickhouse.Connection.Password != "" {
+		masked.Clickhouse.Connection.Password = "***"
+	}
+	masked.Clickhouse.Reserve = maskReserve(masked.Clickhouse.Reserve)
+	if k := masked.Sinks.Kafka; k != nil {
+		kafka := *k
+		kafka.Reserve = maskReserve(k.Reserve)
+		if k.SASL != nil && k.SASL.Password != "" {
+			sasl := *k.SASL
+			sasl.Password = "***"
+			kafka.SASL = &sasl
+		}
+		masked.Sinks.Kafka = &kafka
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(&masked); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// maskReserve returns a copy of r without encryption keys
+func maskReserve(r *ECMSLogger.Reserve) *ECMSLogger.Reserve {
+	if r == nil || r.Encryption == nil {
+		return r
+	}
+	reserve, encryption := *r, *r.Encryption
+	encryption.Keys = make([]ECMSLogger.ReserveKey, len(r.Encryption.Keys))
+	for i, k := range r.Encryption.Keys {
+		k.Key = "***"
+		encryption.Keys[i] = k
+	}
+	reserve.Encryption = &encryption
+	return &reserve
+}
+
+// connect opens ClickHouse and checks it answers in time
+func connect(config *ECMSLogger.Config) (*sqlx.DB, error) {
+	c := &config.Clickhouse.Connection
+	db, err := ECMSLogger.OpenClickhouse(c)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	ECMSLogger "github.com/aido93/ecms-logger"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// inspect prints a summary line per reserve file, or the records themselves
+// as JSON lines with -records. A file or dir passed as argument is read
+// without config when there is none, only encrypted files need its keys.
+func inspect(configFile string, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	showRecords := fs.Bool("records", false, "print records as JSON lines")
+	kafka := fs.Bool("kafka", false, "use the reserve of the Kafka sink")
+	fs.Parse(args)
+	target := fs.Arg(0)
+	var reserve *ECMSLogger.Reserve
+	if _, err := os.Stat(configFile); err == nil || target == "" {
+		config, err := loadConfig(configFile)
+		switch {
+		case err == nil:
+			reserve = configuredReserve(config, *kafka)
+		case target == "":
+			return err
+		default:
+			fmt.Fprintln(os.Stderr, "encrypted files cannot be read:", err)
+		}
+	}
+	if target == "" {
+		if reserve == nil {
+			return errors.New("reserve is not configured, pass a file or dir")
+		}
+		target = reserve.Dir
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	keys, err := reserveKeys(reserve)
+	if err != nil {
+		return err
+	}
+	files := []string{target}
+	if info.IsDir() {
+		if files, err = ECMSLogger.ReserveFiles(target); err != nil {
+			return err
+		}
+	}
+	if *showRecords {
+		for _, f := range files {
+			rf, err := ECMSLogger.ReadReserveFile(f, keys)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			for _, r := range rf.Records {
+				b, _ := json.Marshal(r)
+				fmt.Println(string(b))
+			}
+			printCorrupt(rf)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSIZE\tFORMAT\tCOMPRESSION\tKEY\tRECORDS\tCORRUPT\tFROM\tTO\tERROR")
+	read := []*ECMSLogger.ReserveFile{}
+	for _, f := range files {
+		size := int64(0)
+		if info, err := os.Stat(f); err == nil {
+			size = info.Size()
+		}
+		rf, err := ECMSLogger.ReadReserveFile(f, keys)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%d\t-\t-\t-\t0\t0\t-\t-\t%v\n", f, size, err)
+			continue
+		}
+		format := "json"
+		if rf.FormatVersion > 0 {
+			format = fmt.Sprintf("v%d/schema %d", rf.FormatVersion, rf.SchemaVersion)
+		}
+		compression := rf.Compression
+		if compression == "" {
+			compression = "none"
+		}
+		key := rf.KeyID
+		if key == "" {
+			key = "-"
+		}
+		read = append(read, rf)
+		from, to := timeRange(rf.Records)
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t\n", f, size, format, compression, key, len(rf.Records), len(rf.Corrupt), from, to)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, rf := range read {
+		printCorrupt(rf)
+	}
+	return nil
+}
+
+// configuredReserve returns the reserve of ClickHouse or of the Kafka sink,
+// nil when it is not configured
+func configuredReserve(config *ECMSLogger.Config, kafka bool) *ECMSLogger.Reserve {
+	if !kafka {
+		return config.Clickhouse.Reserve
+	}
+	if config.Sinks.Kafka == nil {
+		return nil
+	}
+	return config.Sinks.Kafka.Reserve
+}
+
+// reserveKeys returns every configured key, so files written with rotated
+// out keys can be read as long as the key is listed
+func reserveKeys(reserve *ECMSLogger.Reserve) (ECMSLogger.ReserveKeys, error) {
+	if reserve == nil {
+		return nil, nil
+	}
+	return ECMSLogger.NewReserveKeys(reserve.Encryption)
+}
+
+func printCorrupt(rf *ECMSLogger.ReserveFile) {
+	for _, c := range rf.Corrupt {
+		fmt.Fprintf(os.Stderr, "%s: corrupted block at %d: %v\n", rf.Name, c.Offset, c.Err)
+	}
+}
+
+func timeRange(records []ECMSLogger.AccessRecord) (string, string) {
+	if len(records) == 0 {
+		return "-", "-"
+	}
+	from, to := records[0].Time, records[0].Time
+	for _, r := range records[1:] {
+		if r.Time.Before(from) {
+			from = r.Time
+		}
+		if r.Time.After(to) {
+			to = r.Time
+		}
+	}
+	return from.Format(time.RFC3339), to.Format(time.RFC3339)
+}
@@ -1,7 +1,7 @@
 package ECMSLogger
 
 import (
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"time"
 )
@@ -20,22 +20,50 @@ type (
 	Reserve struct {
 		Dir    string     `yaml:"dir"`
 		Rotate RotateConf `yaml:"rotate"`
+		// gzip (default), zstd or none
+		Compression string `yaml:"compression"`
+		// total size of reserve files, maxFiles * maxSize by default
+		MaxTotalSize string `yaml:"maxTotalSize"`
+		// keep at least this share of the disk free, 0 disables the check
+		MinFreePercent float64 `yaml:"minFreePercent"`
+		// evict (default) deletes the oldest files when reserve is full, stop
+		// drops new batches
+		OnFull string `yaml:"onFull"`
+		// encrypts new files when set
+		Encryption *Encryption `yaml:"encryption"`
+	}
+
+	ReserveKey struct {
+		ID string `yaml:"id"`
+		// base64 of 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+		Key     string `yaml:"key"`
+		KeyFile string `yaml:"keyFile"`
+	}
+
+	Encryption struct {
+		// key new files are written with, the others are only for reading
+		KeyID string       `yaml:"keyID"`
+		Keys  []ReserveKey `yaml:"keys"`
 	}
 
 	Connection struct {
-		Host      string        `yaml:"host"`
-		Port      string        `yaml:"port"`
-		User      string        `yaml:"user"`
-		Password  string        `yaml:"password"`
-		DB        string        `yaml:"db"`
-		AltHosts  []string      `yaml:"altHosts"`
-		ConnLimit int           `yaml:"connLimit"`
-		IdleLimit int           `yaml:"idleLimit"`
-		Timeout   time.Duration `yaml:"timeout"`
-		Debug     bool          `yaml:"debug"`
+		Host     string `yaml:"host"`
+		Port     string `yaml:"port"`
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+		// file with password, e.g. mounted Kubernetes secret
+		PasswordFile string        `yaml:"passwordFile"`
+		DB           string        `yaml:"db"`
+		AltHosts     []string      `yaml:"altHosts"`
+		ConnLimit    int           `yaml:"connLimit"`
+		IdleLimit    int           `yaml:"idleLimit"`
+		Timeout      time.Duration `yaml:"timeout"`
+		Debug        bool          `yaml:"debug"`
 	}
 
 	ClickhouseSettings struct {
+		// records go only to sinks
+		Disabled     bool          `yaml:"disabled"`
 		Connection   Connection    `yaml:"connection"`
 		Table        string        `yaml:"table"`
 		BatchSize    int           `yaml:"batchSize"`
@@ -44,6 +72,9 @@ type (
 		MaxQueueSize int           `yaml:"maxQueueSize"`
 		Period       time.Duration `yaml:"period"`
 		Reserve      *Reserve      `yaml:"reserve"`
+		// add missing columns on connect, needs ALTER rights. Without it
+		// run ecms-logger migrate after upgrades.
+		Migrate bool `yaml:"migrate"`
 	}
 
 	Fields struct {
@@ -60,21 +91,238 @@ type (
 		Fields         Fields        `yaml:"fields"`
 	}
 
+	Redaction struct {
+		Replacement string   `yaml:"replacement"`
+		Keys        []string `yaml:"keys"`
+		Paths       []string `yaml:"paths"`
+		Patterns    []string `yaml:"patterns"`
+		Regexes     []string `yaml:"regexes"`
+	}
+
+	Headers struct {
+		Request  []string `yaml:"request"`
+		Response []string `yaml:"response"`
+		Redact   []string `yaml:"redact"`
+	}
+
+	UserAgent struct {
+		// path to uap-core regexes.yaml, embedded rules are used when empty
+		Rules     string `yaml:"rules"`
+		CacheSize int    `yaml:"cacheSize"`
+		Disabled  bool   `yaml:"disabled"`
+	}
+
+	BotPattern struct {
+		Name  string `yaml:"name"`
+		Regex string `yaml:"regex"`
+		// reverse DNS domains used for verification
+		Domains []string `yaml:"domains"`
+	}
+
+	Bots struct {
+		Disabled bool          `yaml:"disabled"`
+		Verify   bool          `yaml:"verify"`
+		Timeout  time.Duration `yaml:"timeout"`
+		CacheTTL time.Duration `yaml:"cacheTTL"`
+		// how long failed lookups count as not verified
+		FailureTTL time.Duration `yaml:"failureTTL"`
+		// path to MaxMind ASN database
+		ASNDB       string       `yaml:"asnDB"`
+		HostingOrgs []string     `yaml:"hostingOrgs"`
+		HostingASNs []uint       `yaml:"hostingASNs"`
+		Patterns    []BotPattern `yaml:"patterns"`
+		Skip        bool         `yaml:"skip"`
+	}
+
+	SampleRule struct {
+		// glob, * matches inside one segment, ** matches any segments
+		Path    string   `yaml:"path"`
+		Methods []string `yaml:"methods"`
+		// exact codes or masks like 3xx
+		Status []string `yaml:"status"`
+		// gRPC code names like NotFound
+		RPCCodes  []string `yaml:"rpcCodes"`
+		UserAgent string   `yaml:"userAgent"`
+		Skip      bool     `yaml:"skip"`
+		Rate      *float64 `yaml:"rate"`
+	}
+
+	Sampling struct {
+		// first matching rule wins
+		Rules       []SampleRule  `yaml:"rules"`
+		DefaultRate *float64      `yaml:"defaultRate"`
+		KeepErrors  bool          `yaml:"keepErrors"`
+		SlowerThan  time.Duration `yaml:"slowerThan"`
+	}
+
+	Tracing struct {
+		// incoming request id is reused, generated otherwise. Default X-Request-ID
+		RequestIDHeader string `yaml:"requestIDHeader"`
+	}
+
+	MetricsConf struct {
+		Enabled bool   `yaml:"enabled"`
+		Path    string `yaml:"path"`
+		// values of the category label of request metrics, other categories
+		// are counted as other
+		Categories []string `yaml:"categories"`
+	}
+
+	DurationThreshold struct {
+		Degraded  time.Duration `yaml:"degraded"`
+		Unhealthy time.Duration `yaml:"unhealthy"`
+	}
+
+	RatioThreshold struct {
+		Degraded  float64 `yaml:"degraded"`
+		Unhealthy float64 `yaml:"unhealthy"`
+	}
+
+	HealthThresholds struct {
+		FlushAge    DurationThreshold `yaml:"flushAge"`
+		QueueFill   RatioThreshold    `yaml:"queueFill"`
+		ReserveFill RatioThreshold    `yaml:"reserveFill"`
+		GeoIPAge    DurationThreshold `yaml:"geoipAge"`
+	}
+
+	HealthConf struct {
+		Enabled bool   `yaml:"enabled"`
+		Path    string `yaml:"path"`
+		// ClickHouse ping timeout
+		Timeout    time.Duration    `yaml:"timeout"`
+		Thresholds HealthThresholds `yaml:"thresholds"`
+	}
+
+	FileSinkConf struct {
+		Dir string `yaml:"dir"`
+		// file names start with it, access by default
+		Name string `yaml:"name"`
+		// json (default), logfmt or combined
+		Format string `yaml:"format"`
+		// the current file is rotated when it reaches maxSize or is older
+		// than period
+		MaxSize string        `yaml:"maxSize"`
+		Period  time.Duration `yaml:"period"`
+		// gzip rotated files
+		Compress bool `yaml:"compress"`
+		// retention of rotated files, zero values are not checked
+		MaxFiles     int           `yaml:"maxFiles"`
+		MaxTotalSize string        `yaml:"maxTotalSize"`
+		MaxAge       time.Duration `yaml:"maxAge"`
+		QueueSize    int           `yaml:"queueSize"`
+	}
+
+	StdoutSinkConf struct {
+		// stdout (default) or stderr
+		Stream string `yaml:"stream"`
+		// snake (column names, default) or camel (JSON names)
+		Naming string `yaml:"naming"`
+		// keys to write in the chosen naming, all by default
+		Fields []string `yaml:"fields"`
+		// skip empty strings, zeros and false
+		OmitEmpty bool `yaml:"omitEmpty"`
+		QueueSize int  `yaml:"queueSize"`
+	}
+
+	KafkaSinkConf struct {
+		// bootstrap brokers, host:port
+		Brokers  []string `yaml:"brokers"`
+		Topic    string   `yaml:"topic"`
+		ClientID string   `yaml:"clientID"`
+		// column used as message key, request_id by default. Records with
+		// the same key go to the same partition. "-" sends records without
+		// key spread over partitions.
+		Key string `yaml:"key"`
+		// json (JSONEachRow, default) or protobuf (ProtobufSingle)
+		Format string `yaml:"format"`
+		// all (default), leader or none
+		Acks string `yaml:"acks"`
+		// no duplicates on retries, requires acks: all
+		Idempotent bool `yaml:"idempotent"`
+		// none (default), gzip, snappy, lz4 or zstd
+		Compression string `yaml:"compression"`
+		// a batch is produced when it has batchSize records or period passed
+		BatchSize int           `yaml:"batchSize"`
+		Period    time.Duration `yaml:"period"`
+		Timeout   time.Duration `yaml:"timeout"`
+		Retries   int           `yaml:"retries"`
+		QueueSize int           `yaml:"queueSize"`
+		// undelivered batches, replay them with ecms-logger replay -kafka
+		Reserve *Reserve   `yaml:"reserve"`
+		TLS     *KafkaTLS  `yaml:"tls"`
+		SASL    *KafkaSASL `yaml:"sasl"`
+	}
+
+	// KafkaTLS enables TLS, an empty section verifies brokers with the
+	// system roots
+	KafkaTLS struct {
+		CAFile string `yaml:"caFile"`
+		// client certificate for mutual TLS
+		CertFile           string `yaml:"certFile"`
+		KeyFile            string `yaml:"keyFile"`
+		ServerName         string `yaml:"serverName"`
+		InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	}
+
+	KafkaSASL struct {
+		// plain, scram-sha-256 or scram-sha-512
+		Mechanism    string `yaml:"mechanism"`
+		User         string `yaml:"user"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"passwordFile"`
+	}
+
+	Sinks struct {
+		File   *FileSinkConf   `yaml:"file"`
+		Stdout *StdoutSinkConf `yaml:"stdout"`
+		Kafka  *KafkaSinkConf  `yaml:"kafka"`
+	}
+
 	Config struct {
 		MaxMind    MaxMind            `yaml:"maxmind"`
 		Clickhouse ClickhouseSettings `yaml:"clickhouse"`
 		Session    Session            `yaml:"session"`
+		Redaction  Redaction          `yaml:"redaction"`
+		Headers    Headers            `yaml:"headers"`
+		UserAgent  UserAgent          `yaml:"userAgent"`
+		Bots       Bots               `yaml:"bots"`
+		Sampling   Sampling           `yaml:"sampling"`
+		Tracing    Tracing            `yaml:"tracing"`
+		Metrics    MetricsConf        `yaml:"metrics"`
+		Health     HealthConf         `yaml:"health"`
+		Sinks      Sinks              `yaml:"sinks"`
 	}
 )
 
+// ReadConfig reads YAML config, applies defaults and validates it. ${VAR}
+// references are replaced in parsed values, ECMS_LOGGER_* variables and
+// *File secret fields are applied after it.
 func ReadConfig(filename string) (Config, error) {
 	c := Config{}
 	yamlFile, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return Config{}, err
 	}
-	err = yaml.Unmarshal(yamlFile, &c)
-	if err != nil {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(yamlFile, &doc); err != nil {
+		return Config{}, err
+	}
+	if err := interpolateEnv(&doc); err != nil {
+		return Config{}, err
+	}
+	// an empty file has no document
+	if doc.Kind != 0 {
+		if err := doc.Decode(&c); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := applyEnvOverrides(&c); err != nil {
+		return Config{}, err
+	}
+	if err := applySecretFiles(&c); err != nil {
+		return Config{}, err
+	}
+	if err := c.Validate(); err != nil {
 		return Config{}, err
 	}
 	return c, nil
@@ -0,0 +1,239 @@
+package ECMSLogger
+
+import (
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const EnvPrefix = "ECMS_LOGGER"
+
+// ${VAR} or ${VAR:-default}. Plain $VAR is left as is, because regexes in
+// config use $ as an anchor.
+var envRefRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateEnv replaces ${VAR} references in string scalars of the parsed
+// config, so values are never parsed as YAML and comments are left as they
+// are. A plain scalar is resolved again after replacing, e.g. batchSize:
+// ${BATCH} becomes a number. Undefined variables without default are
+// reported together.
+func interpolateEnv(doc *yaml.Node) error {
+	missing := []string{}
+	visited := map[*yaml.Node]bool{}
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, child := range n.Content {
+			walk(child)
+		}
+		if n.Kind != yaml.ScalarNode || n.ShortTag() != "!!str" || !strings.Contains(n.Value, "${") {
+			return
+		}
+		n.Value = envRefRegex.ReplaceAllStringFunc(n.Value, func(m string) string {
+			sub := envRefRegex.FindStringSubmatch(m)
+			if v, ok := os.LookupEnv(sub[1]); ok {
+				return v
+			}
+			if sub[2] != "" {
+				return sub[3]
+			}
+			missing = append(missing, sub[1])
+			return m
+		})
+		if n.Style == 0 {
+			n.Tag = ""
+		}
+	}
+	walk(doc)
+	if len(missing) > 0 {
+		return errors.New("undefined environment variables in config: " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// applyEnvOverrides sets fields from ECMS_LOGGER_<PATH> variables where PATH
+// is the YAML path in upper case joined with underscores, e.g.
+// ECMS_LOGGER_CLICKHOUSE_CONNECTION_PASSWORD or ECMS_LOGGER_CLICKHOUSE_BATCHSIZE.
+// Lists of strings are comma separated, other values are parsed as YAML.
+func applyEnvOverrides(c *Config) error {
+	errs := ValidationErrors{}
+	overrideValue(reflect.ValueOf(c).Elem(), EnvPrefix, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func envHasPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func overrideValue(v reflect.Value, env string, path string, errs *ValidationErrors) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			childPath := tag
+			if path != "" {
+				childPath = path + "." + tag
+			}
+			overrideValue(v.Field(i), env+"_"+strings.ToUpper(tag), childPath, errs)
+		}
+		return
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			if v.IsNil() {
+				if !envHasPrefix(env) {
+					return
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			overrideValue(v.Elem(), env, path, errs)
+			return
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, env+"_") {
+				continue
+			}
+			parts := strings.SplitN(kv[len(env)+1:], "=", 2)
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			// map keys keep their case from YAML, e.g. remoteAddr
+			v.SetMapIndex(reflect.ValueOf(mapKey(v, parts[0])), reflect.ValueOf(parts[1]))
+		}
+		return
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			return
+		}
+	}
+	value, ok := os.LookupEnv(env)
+	if !ok {
+		return
+	}
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Slice && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		if v.Type().Elem().Kind() == reflect.String {
+			items := []string{}
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					items = append(items, s)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return
+		}
+		if err := yaml.Unmarshal([]byte("["+value+"]"), v.Addr().Interface()); err != nil {
+			errs.add(path, "cannot parse %s=%q: %v", env, value, err)
+		}
+	default:
+		if err := yaml.Unmarshal([]byte(value), v.Addr().Interface()); err != nil {
+			errs.add(path, "cannot parse %s=%q: %v", env, value, err)
+		}
+	}
+}
+
+// mapKey finds existing key ignoring case, so ECMS_LOGGER_MAXMIND_SOURCE_REMOTEADDR
+// overrides remoteAddr
+func mapKey(m reflect.Value, envKey string) string {
+	for _, k := range m.MapKeys() {
+		if strings.EqualFold(k.String(), envKey) {
+			return k.String()
+		}
+	}
+	for _, known := range []string{"remoteAddr", "header"} {
+		if strings.EqualFold(known, envKey) {
+			return known
+		}
+	}
+	return strings.ToLower(envKey)
+}
+
+// applySecretFiles reads every `<field>File` string field into `<field>`,
+// e.g. clickhouse.connection.passwordFile into password. Trailing newline of
+// the file is dropped.
+func applySecretFiles(c *Config) error {
+	errs := ValidationErrors{}
+	readSecrets(reflect.ValueOf(c).Elem(), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func readSecrets(v reflect.Value, path string, errs *ValidationErrors) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		fieldPath := tag
+		if path != "" {
+			fieldPath = path + "." + tag
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct || field.Kind() == reflect.Ptr {
+			readSecrets(field, fieldPath, errs)
+			continue
+		}
+		if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < field.Len(); j++ {
+				readSecrets(field.Index(j), fieldPath+"["+strconv.Itoa(j)+"]", errs)
+			}
+			continue
+		}
+		if field.Kind() != reflect.String || !strings.HasSuffix(f.Name, "File") || field.String() == "" {
+			continue
+		}
+		target := v.FieldByName(strings.TrimSuffix(f.Name, "File"))
+		if !target.IsValid() || target.Kind() != reflect.String {
+			continue
+		}
+		targetPath := strings.TrimSuffix(fieldPath, "File")
+		if target.String() != "" {
+			errs.add(fieldPath, "set either %s or %s", targetPath, fieldPath)
+			continue
+		}
+		b, err := ioutil.ReadFile(field.String())
+		if err != nil {
+			errs.add(fieldPath, "%v", err)
+			continue
+		}
+		target.SetString(strings.TrimRight(string(b), "\r\n"))
+	}
+}
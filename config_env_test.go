@@ -0,0 +1,254 @@
+package ECMSLogger
+
+import (
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	env := map[string]string{
+		"ECMS_TEST_TABLE":    "access",
+		"ECMS_TEST_BATCH":    "500",
+		"ECMS_TEST_PERIOD":   "5s",
+		"ECMS_TEST_PASSWORD": `p#ss: "it's" # not a comment`,
+		"ECMS_TEST_HOSTS":    "a:9000, b:9000",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	config := `# set ${ECMS_TEST_UNDEFINED} to change the table
+table: ${ECMS_TEST_TABLE} # or ${ECMS_TEST_UNDEFINED}
+batchSize: ${ECMS_TEST_BATCH}
+period: ${ECMS_TEST_PERIOD}
+#  host: ${ECMS_TEST_UNDEFINED}
+password: ${ECMS_TEST_PASSWORD}
+quoted: "${ECMS_TEST_PASSWORD}"
+number: "${ECMS_TEST_BATCH}"
+block: |
+  # ${ECMS_TEST_TABLE}
+  ${ECMS_TEST_BATCH:-1}
+hosts:
+  - ${ECMS_TEST_HOSTS}
+after: ${ECMS_TEST_MISSING:-default} # ${ECMS_TEST_UNDEFINED}
+`
+	type result struct {
+		Table     string
+		BatchSize int `yaml:"batchSize"`
+		Period    time.Duration
+		Password  string
+		Quoted    string
+		Number    string
+		Block     string
+		Hosts     []string
+		After     string
+	}
+	want := result{
+		Table:     "access",
+		BatchSize: 500,
+		Period:    5 * time.Second,
+		Password:  env["ECMS_TEST_PASSWORD"],
+		Quoted:    env["ECMS_TEST_PASSWORD"],
+		Number:    "500",
+		Block:     "# access\n500\n",
+		Hosts:     []string{"a:9000, b:9000"},
+		After:     "default",
+	}
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := interpolateEnv(&doc); err != nil {
+		t.Fatal(err)
+	}
+	got := result{}
+	if err := doc.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	for _, tc := range []struct {
+		config  string
+		missing []string
+	}{
+		{"table: ${ECMS_TEST_UNDEFINED} # ${ECMS_TEST_TABLE}\n", []string{"ECMS_TEST_UNDEFINED"}},
+		{"a: ${ECMS_TEST_UNDEFINED}\nb: [x, '${ECMS_TEST_OTHER}']\n", []string{"ECMS_TEST_UNDEFINED", "ECMS_TEST_OTHER"}},
+	} {
+		doc := yaml.Node{}
+		if err := yaml.Unmarshal([]byte(tc.config), &doc); err != nil {
+			t.Fatal(err)
+		}
+		err := interpolateEnv(&doc)
+		if err == nil {
+			t.Errorf("%q: no error", tc.config)
+			continue
+		}
+		for _, name := range tc.missing {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("%q: %v", tc.config, err)
+			}
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		env   map[string]string
+		check func(c *Config) bool
+		err   string
+	}{
+		{
+			name:  "string",
+			env:   map[string]string{"ECMS_LOGGER_CLICKHOUSE_CONNECTION_PASSWORD": "p#ss: 'x'"},
+			check: func(c *Config) bool { return c.Clickhouse.Connection.Password == "p#ss: 'x'" },
+		},
+		{
+			name:  "number and duration",
+			env:   map[string]string{"ECMS_LOGGER_CLICKHOUSE_BATCHSIZE": "500", "ECMS_LOGGER_CLICKHOUSE_PERIOD": "30s"},
+			check: func(c *Config) bool { return c.Clickhouse.BatchSize == 500 && c.Clickhouse.Period == 30*time.Second },
+		},
+		{
+			name:  "bool",
+			env:   map[string]string{"ECMS_LOGGER_BOTS_SKIP": "true"},
+			check: func(c *Config) bool { return c.Bots.Skip },
+		},
+		{
+			name:  "string list",
+			env:   map[string]string{"ECMS_LOGGER_HEADERS_REQUEST": "Accept, X-Request-ID,"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.Headers.Request, []string{"Accept", "X-Request-ID"}) },
+		},
+		{
+			name:  "number list",
+			env:   map[string]string{"ECMS_LOGGER_BOTS_HOSTINGASNS": "13335, 16509"},
+			check: func(c *Config) bool { return reflect.DeepEqual(c.Bots.HostingASNs, []uint{13335, 16509}) },
+		},
+		{
+			name: "map key keeps its case",
+			env:  map[string]string{"ECMS_LOGGER_MAXMIND_SOURCE_REMOTEADDR": "true"},
+			check: func(c *Config) bool {
+				return c.MaxMind.Source["remoteAddr"] == "true" && c.MaxMind.Source["header"] == "X-Real-IP"
+			},
+		},
+		{
+			name: "missing section is created",
+			env:  map[string]string{"ECMS_LOGGER_SINKS_STDOUT_NAMING": "camel"},
+			check: func(c *Config) bool {
+				return c.Sinks.Stdout != nil && c.Sinks.Stdout.Naming == "camel" && c.Sinks.File == nil
+			},
+		},
+		{
+			name: "wrong number",
+			env:  map[string]string{"ECMS_LOGGER_CLICKHOUSE_BATCHSIZE": "many"},
+			err:  "clickhouse.batchSize",
+		},
+		{
+			name: "wrong duration",
+			env:  map[string]string{"ECMS_LOGGER_CLICKHOUSE_PERIOD": "soon"},
+			err:  "clickhouse.period",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			c := &Config{}
+			c.Clickhouse.BatchSize = 100
+			c.MaxMind.Source = map[string]string{"header": "X-Real-IP"}
+			err := applyEnvOverrides(c)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Errorf("%+v", c)
+			}
+		})
+	}
+}
+
+func TestApplySecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := func(name, value string) string {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	password := secret("password", "s3cret: #1\n")
+	key := secret("key", testKey1+"\r\n")
+	for _, tt := range []struct {
+		name  string
+		set   func(c *Config)
+		check func(c *Config) bool
+		err   string
+	}{
+		{
+			name:  "password",
+			set:   func(c *Config) { c.Clickhouse.Connection.PasswordFile = password },
+			check: func(c *Config) bool { return c.Clickhouse.Connection.Password == "s3cret: #1" },
+		},
+		{
+			name: "nested",
+			set: func(c *Config) {
+				c.Clickhouse.Reserve = &Reserve{Encryption: &Encryption{Keys: []ReserveKey{{ID: "k0", Key: testKey2}, {ID: "k1", KeyFile: key}}}}
+				c.Sinks.Kafka = &KafkaSinkConf{SASL: &KafkaSASL{PasswordFile: password}}
+			},
+			check: func(c *Config) bool {
+				keys := c.Clickhouse.Reserve.Encryption.Keys
+				return keys[0].Key == testKey2 && keys[1].Key == testKey1 && c.Sinks.Kafka.SASL.Password == "s3cret: #1"
+			},
+		},
+		{
+			name: "both set",
+			set: func(c *Config) {
+				c.Clickhouse.Connection.Password = "inline"
+				c.Clickhouse.Connection.PasswordFile = password
+			},
+			err: "set either clickhouse.connection.password or clickhouse.connection.passwordFile",
+		},
+		{
+			name: "missing file",
+			set: func(c *Config) {
+				c.Clickhouse.Reserve = &Reserve{Encryption: &Encryption{Keys: []ReserveKey{{ID: "k1", KeyFile: filepath.Join(dir, "missing")}}}}
+			},
+			err: "clickhouse.reserve.encryption.keys[0].keyFile",
+		},
+	} {
+		c := &Config{}
+		tt.set(c)
+		err := applySecretFiles(c)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(c) {
+			t.Errorf("%s: %+v", tt.name, c)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package ECMSLogger
+
+// diskSpace is not supported here, minFreePercent is ignored
+func diskSpace(dir string) (free, total int64, ok bool) {
+	return 0, 0, false
+}
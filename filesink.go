@@ -0,0 +1,256 @@
+package ECMSLogger
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileSink writes records to local files for services without ClickHouse
+// or as a local copy. The current file is rotated by size and age, rotated
+// files are optionally gzipped and deleted by count, total size and age.
+type FileSink struct {
+	conf     *FileSinkConf
+	format   recordFormatter
+	maxSize  int64
+	rotation *rotation
+	metrics  *Metrics
+	log      *log.Entry
+	records  chan AccessRecord
+	// owned by the write goroutine
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+	opened time.Time
+	buf    bytes.Buffer
+
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+}
+
+func newFileSink(conf *FileSinkConf, metrics *Metrics) (*FileSink, error) {
+	format, err := newRecordFormatter(conf.Format)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := ParseSize(conf.MaxSize)
+	if maxSize <= 0 {
+		return nil, errors.New("Wrong file sink maxSize: " + conf.MaxSize)
+	}
+	maxTotalSize := int64(0)
+	if conf.MaxTotalSize != "" {
+		if maxTotalSize = ParseSize(conf.MaxTotalSize); maxTotalSize <= 0 {
+			return nil, errors.New("Wrong file sink maxTotalSize: " + conf.MaxTotalSize)
+		}
+	}
+	s := &FileSink{
+		conf:    conf,
+		format:  format,
+		maxSize: maxSize,
+		metrics: metrics,
+		log:     log.WithField("sink", "file"),
+		records: make(chan AccessRecord, conf.QueueSize),
+		done:    make(chan struct{}),
+	}
+	s.rotation = &rotation{
+		dir:          conf.Dir,
+		prefix:       conf.Name + "-",
+		ext:          ".log",
+		maxFiles:     conf.MaxFiles,
+		maxTotalSize: maxTotalSize,
+		maxAge:       conf.MaxAge,
+		log:          s.log,
+	}
+	if err := CheckTouch(conf.Dir); err != nil {
+		return nil, errors.New("Cannot touch in " + conf.Dir + ": " + err.Error())
+	}
+	if err := s.rotation.init(); err != nil {
+		return nil, err
+	}
+	if err := claimDir(conf.Dir, s.rotation.prefix); err != nil {
+		return nil, err
+	}
+	if conf.Compress {
+		// files of the previous run
+		s.compressAll()
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queues the record, it is dropped when the queue is full
+func (s *FileSink) Send(ar AccessRecord) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		s.metrics.observeDropped("closed", 1)
+		return
+	}
+	select {
+	case s.records <- ar:
+	default:
+		s.metrics.observeDropped("file_queue_full", 1)
+	}
+}
+
+// Close writes queued records and closes the current file
+func (s *FileSink) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.records)
+	s.closeMu.Unlock()
+	<-s.done
+	releaseDir(s.conf.Dir, s.rotation.prefix)
+	return s.closeFile()
+}
+
+func (s *FileSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case ar, ok := <-s.records:
+			if !ok {
+				return
+			}
+			s.write(&ar)
+			if len(s.records) == 0 && s.w != nil {
+				if err := s.w.Flush(); err != nil {
+					s.log.Error(err)
+				}
+			}
+		case <-ticker.C:
+			if s.file != nil && s.conf.Period > 0 && time.Since(s.opened) >= s.conf.Period {
+				s.rotate()
+			}
+		}
+	}
+}
+
+func (s *FileSink) write(ar *AccessRecord) {
+	s.buf.Reset()
+	if err := s.format(&s.buf, ar); err != nil {
+		s.log.Error(err)
+		s.metrics.observeDropped("file_failed", 1)
+		return
+	}
+	if s.file != nil && (s.size+int64(s.buf.Len()) > s.maxSize || (s.conf.Period > 0 && time.Since(s.opened) >= s.conf.Period)) {
+		s.rotate()
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			s.log.Error("Cannot open log file: ", err)
+			s.metrics.observeDropped("file_failed", 1)
+			return
+		}
+	}
+	n, err := s.w.Write(s.buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		s.log.Error(err)
+		s.metrics.observeDropped("file_failed", 1)
+	}
+}
+
+func (s *FileSink) open() error {
+	if err := s.rotation.makeRoom(0); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.rotation.next(-1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.size = 0
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *FileSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	name := s.file.Name()
+	s.file, s.w = nil, nil
+	if s.conf.Compress {
+		if cerr := compressFile(name); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// rotate closes the current file, the next write opens a new one
+func (s *FileSink) rotate() {
+	if err := s.closeFile(); err != nil {
+		s.log.Error("Cannot rotate log file: ", err)
+	}
+}
+
+func (s *FileSink) compressAll() {
+	files, err := s.rotation.files()
+	if err != nil {
+		s.log.Error(err)
+		return
+	}
+	for _, f := range files {
+		if !f.compressed {
+			if err := compressFile(f.path); err != nil {
+				s.log.Error(err)
+			}
+		}
+	}
+}
+
+// compressFile replaces name with name.gz, the file is streamed as it may
+// be as big as maxSize
+func compressFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dir, base := filepath.Split(name)
+	tmp := filepath.Join(dir, "."+base+gzipExt+".tmp")
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+gzipExt)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,164 @@
+package ECMSLogger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFileSink(t *testing.T, conf FileSinkConf) (*FileSink, string) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Dir = dir
+	if conf.Name == "" {
+		conf.Name = "access"
+	}
+	conf.QueueSize = 1000
+	s, err := newFileSink(&conf, newMetrics(nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+// readFileSink closes the sink and returns its files, the oldest first
+func readFileSink(t *testing.T, s *FileSink) ([]rotatedFile, []string) {
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.rotation.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]string, len(files))
+	for i, f := range files {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[i] = string(b)
+	}
+	return files, contents
+}
+
+var formatTestRecord = AccessRecord{
+	Time:           time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC),
+	RemoteAddr:     "203.0.113.9",
+	User:           "alice",
+	Method:         "GET",
+	RequestURI:     "/v1/items?q=a b",
+	Status:         200,
+	ResponseLength: 512,
+	DurationUs:     1500,
+	UserAgent:      `curl/8.0 "x"`,
+	RequestHeaders: map[string]string{"Referer": "https://example.com/"},
+}
+
+func testFileSinkFormat(t *testing.T, format, want string) {
+	s, dir := testFileSink(t, FileSinkConf{Format: format, MaxSize: "1m"})
+	defer os.RemoveAll(dir)
+	s.Send(formatTestRecord)
+	_, contents := readFileSink(t, s)
+	if len(contents) != 1 || contents[0] != want {
+		t.Errorf("got\n%q\nwant\n%q", contents, want)
+	}
+}
+
+func TestFileSinkJSON(t *testing.T) {
+	testFileSinkFormat(t, FormatJSON, `{"time":"2024-03-01T10:20:30Z","clientTime":"0001-01-01T00:00:00Z","kind":"","requestID":"",`+
+		`"traceID":"","spanID":"","parentSpanID":"","traceState":"","redisDurationUs":0,"host":"","method":"GET",`+
+		`"requestURI":"/v1/items?q=a b","version":"","category":"","Subject":"","remoteAddr":"203.0.113.9","contentLength":0,`+
+		`"continent":"","country":"","isoCountry":"","city":"","latitude":0,"longitude":0,"accuracyRadius":0,"timezone":"",`+
+		`"subdivision":"","euMember":false,"durationUs":1500,"dbDurationUs":0,"dbQueries":0,"dbSlowestUs":0,"dbSlowestQuery":"",`+
+		`"redisCalls":0,"os":"","browser":"","width":0,"height":0,"osVersion":"","browserVersion":"","deviceType":"",`+
+		`"isBot":false,"botName":"","botVerified":false,"hostingOrg":"","user":"alice","userAgent":"curl/8.0 \"x\"",`+
+		`"source":"","target":"","params":"","clientName":"","clientBranch":"","clientCommitHash":"","clientTag":"",`+
+		`"requestHeaders":{"Referer":"https://example.com/"},"status":200,"response":"","responseLength":512,"error":"",`+
+		`"rpcCode":"","requestMessages":0,"responseMessages":0,"sampleRate":0,"region":"","location":"","branch":"",`+
+		`"commitHash":"","tag":""}`+"\n")
+}
+
+func TestFileSinkLogfmt(t *testing.T) {
+	testFileSinkFormat(t, FormatLogfmt, `time=2024-03-01T10:20:30Z method=GET request_uri="/v1/items?q=a b" `+
+		`remote_addr=203.0.113.9 duration_us=1500 user=alice user_agent="curl/8.0 \"x\"" status=200 `+
+		`response_length=512 request_headers.Referer=https://example.com/`+"\n")
+}
+
+func TestFileSinkCombined(t *testing.T) {
+	testFileSinkFormat(t, FormatCombined, `203.0.113.9 - alice [01/Mar/2024:10:20:30 +0000] "GET /v1/items?q=a b" 200 512 `+
+		`"https://example.com/" "curl/8.0 \x22x\x22"`+"\n")
+}
+
+// sendNumbered sends records whose combined lines are 65 bytes
+func sendNumbered(s *FileSink, n int) {
+	for i := 0; i < n; i++ {
+		s.Send(AccessRecord{Time: formatTestRecord.Time, Method: "GET", RequestURI: fmt.Sprintf("/items/%02d", i), Status: 200})
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	s, dir := testFileSink(t, FileSinkConf{Format: FormatCombined, MaxSize: "140b", MaxFiles: 3})
+	defer os.RemoveAll(dir)
+	sendNumbered(s, 20)
+	files, contents := readFileSink(t, s)
+	if len(files) != 3 {
+		t.Fatalf("%d files", len(files))
+	}
+	// two lines fit into a file, files of older records are deleted
+	for i, f := range files {
+		if f.seq != int64(8+i) || f.size > 140 {
+			t.Errorf("file %d: %+v", i, f)
+		}
+		for j, line := range strings.Split(strings.TrimSuffix(contents[i], "\n"), "\n") {
+			if want := fmt.Sprintf("/items/%02d", 14+2*i+j); !strings.Contains(line, want) {
+				t.Errorf("file %d line %d: %s, want %s", i, j, line, want)
+			}
+		}
+	}
+}
+
+func TestFileSinkTotalSize(t *testing.T) {
+	s, dir := testFileSink(t, FileSinkConf{Format: FormatCombined, MaxSize: "140b", MaxTotalSize: "270b"})
+	defer os.RemoveAll(dir)
+	sendNumbered(s, 20)
+	files, contents := readFileSink(t, s)
+	// rotated files keep within maxTotalSize, the current file comes on top
+	total := int64(0)
+	for _, f := range files[:len(files)-1] {
+		total += f.size
+	}
+	if len(files) != 3 || total > 270 {
+		t.Fatalf("%d files of %d bytes", len(files), total)
+	}
+	if !strings.Contains(contents[2], "/items/19") || !strings.Contains(contents[0], "/items/14") {
+		t.Errorf("%q", contents)
+	}
+}
+
+func TestFileSinkMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := fmt.Sprintf("%s/access-%0*d_%d.log", dir, rotatedSeqDigits, 7, time.Now().Add(-2*time.Hour).Unix())
+	if err := ioutil.WriteFile(old, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newFileSink(&FileSinkConf{Dir: dir, Name: "access", Format: FormatCombined, MaxSize: "1m", MaxAge: time.Hour, QueueSize: 10}, newMetrics(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendNumbered(s, 1)
+	files, _ := readFileSink(t, s)
+	// numbering continues after the expired file
+	if len(files) != 1 || files[0].seq != 8 {
+		t.Errorf("%+v", files)
+	}
+}
@@ -0,0 +1,160 @@
+package ECMSLogger
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	grpcUnaryMethod  = "GRPC"
+	grpcStreamMethod = "GRPC_STREAM"
+)
+
+// validRPCCode reports whether name is a gRPC code as stored in rpc_code,
+// e.g. NotFound
+func validRPCCode(name string) bool {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if c.String() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func metadataHeader(md metadata.MD) http.Header {
+	h := make(http.Header, len(md))
+	for k, v := range md {
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	return h
+}
+
+// splitFullMethod turns /package.Service/Method into service and method
+func splitFullMethod(fullMethod string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(fullMethod, "/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// messageSize is the encoded size of a protobuf message, messages generated
+// for the old API are converted
+func messageSize(m interface{}) int64 {
+	switch pm := m.(type) {
+	case proto.Message:
+		return int64(proto.Size(pm))
+	case protoadapt.MessageV1:
+		return int64(proto.Size(protoadapt.MessageV2Of(pm)))
+	}
+	return 0
+}
+
+// newRPCLog fills the record from gRPC metadata and peer. Service becomes
+// Category and method becomes Subject.
+func (m *Middleware) newRPCLog(ctx context.Context, fullMethod string, method string) *RequestLog {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := metadataHeader(md)
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remoteAddr = p.Addr.String()
+	}
+	l := m.startRequestLog()
+	l.fillSession((&http.Request{Header: h}).WithContext(ctx))
+	l.record.fillTrace(h, http.Header{}, l.s.requestIDHeader)
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		l.record.Host = authority[0]
+	}
+	l.record.Method = method
+	l.record.RequestURI = fullMethod
+	service, rpc := splitFullMethod(fullMethod)
+	l.fillRoute("", service, rpc)
+	l.fillHeaders(h)
+	l.fillClient(m.clientAddr(h, remoteAddr))
+	return l
+}
+
+// finishRPC stores the gRPC code, Status stays 0 as there is no HTTP
+// response
+func (l *RequestLog) finishRPC(size int64, err error) {
+	st := status.Convert(err)
+	l.record.RPCCode = st.Code().String()
+	if err != nil {
+		l.record.Error = st.Message()
+	}
+	l.finish(0, size, nil)
+}
+
+func (m *Middleware) ClickhouseUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	l := m.newRPCLog(ctx, info.FullMethod, grpcUnaryMethod)
+	grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(l.s.requestIDHeader), l.record.RequestID))
+	l.record.ContentLength = messageSize(req)
+	l.record.RequestMessages = 1
+	resp, err := handler(NewContext(ctx, l), req)
+	size := int64(0)
+	if err == nil {
+		size = messageSize(resp)
+		l.record.ResponseMessages = 1
+	}
+	l.finishRPC(size, err)
+	return resp, err
+}
+
+// loggedStream counts messages of a stream. Send and receive may run in
+// different goroutines, so counters are atomic.
+type loggedStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	recvCount uint32
+	sentCount uint32
+	recvBytes int64
+	sentBytes int64
+}
+
+func (s *loggedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		atomic.AddUint32(&s.recvCount, 1)
+		atomic.AddInt64(&s.recvBytes, messageSize(m))
+	}
+	return err
+}
+
+func (s *loggedStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		atomic.AddUint32(&s.sentCount, 1)
+		atomic.AddInt64(&s.sentBytes, messageSize(m))
+	}
+	return err
+}
+
+// ClickhouseStreamInterceptor writes one summary record per stream when the
+// handler returns
+func (m *Middleware) ClickhouseStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	l := m.newRPCLog(ss.Context(), info.FullMethod, grpcStreamMethod)
+	ss.SetHeader(metadata.Pairs(strings.ToLower(l.s.requestIDHeader), l.record.RequestID))
+	s := &loggedStream{ServerStream: ss, ctx: NewContext(ss.Context(), l)}
+	err := handler(srv, s)
+	l.record.RequestMessages = atomic.LoadUint32(&s.recvCount)
+	l.record.ResponseMessages = atomic.LoadUint32(&s.sentCount)
+	l.record.ContentLength = atomic.LoadInt64(&s.recvBytes)
+	l.finishRPC(atomic.LoadInt64(&s.sentBytes), err)
+	return err
+}
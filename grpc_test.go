@@ -0,0 +1,109 @@
+package ECMSLogger
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+func TestUnaryInterceptor(t *testing.T) {
+	req := wrapperspb.String("alice")
+	for _, tt := range []struct {
+		name string
+		err  error
+		code string
+		// Error of the record
+		message string
+	}{
+		{"ok", nil, "OK", ""},
+		{"not found", status.Error(codes.NotFound, "no such user"), "NotFound", "no such user"},
+		{"plain error", context.Canceled, "Unknown", "context canceled"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, sink := testMiddleware(t)
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "users:443", "user-agent", "grpc-go/1.29.1"))
+			info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Users/Get"}
+			m.ClickhouseUnaryInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return wrapperspb.Int64(42), nil
+			})
+			if len(sink.records) != 1 {
+				t.Fatalf("%d records", len(sink.records))
+			}
+			r := sink.records[0]
+			if r.Status != 0 || r.RPCCode != tt.code || r.Error != tt.message {
+				t.Errorf("status %d, code %q, error %q", r.Status, r.RPCCode, r.Error)
+			}
+			if r.Method != grpcUnaryMethod || r.Host != "users:443" || r.Category != "pkg.Users" || r.Subject != "Get" {
+				t.Errorf("%+v", r)
+			}
+			if r.ContentLength != 7 || r.RequestMessages != 1 {
+				t.Errorf("request of %d bytes in %d messages", r.ContentLength, r.RequestMessages)
+			}
+			if tt.err == nil && (r.ResponseLength != 2 || r.ResponseMessages != 1) {
+				t.Errorf("response of %d bytes in %d messages", r.ResponseLength, r.ResponseMessages)
+			}
+		})
+	}
+}
+
+// testServerStream receives the given messages
+type testServerStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv []string
+}
+
+func (s *testServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testServerStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (s *testServerStream) RecvMsg(m interface{}) error {
+	if len(s.recv) == 0 {
+		return status.Error(codes.OutOfRange, "end of stream")
+	}
+	m.(*wrapperspb.StringValue).Value, s.recv = s.recv[0], s.recv[1:]
+	return nil
+}
+
+func (s *testServerStream) SendMsg(interface{}) error {
+	return nil
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	m, sink := testMiddleware(t)
+	ss := &testServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.MD{}), recv: []string{"a", "bc"}}
+	info := &grpc.StreamServerInfo{FullMethod: "/pkg.Users/Watch"}
+	err := m.ClickhouseStreamInterceptor(nil, ss, info, func(srv interface{}, stream grpc.ServerStream) error {
+		for {
+			var msg wrapperspb.StringValue
+			if err := stream.RecvMsg(&msg); err != nil {
+				return err
+			}
+			if err := stream.SendMsg(wrapperspb.String(msg.Value + msg.Value)); err != nil {
+				return err
+			}
+		}
+	})
+	if status.Code(err) != codes.OutOfRange || len(sink.records) != 1 {
+		t.Fatalf("%v, %d records", err, len(sink.records))
+	}
+	r := sink.records[0]
+	if r.Method != grpcStreamMethod || r.Status != 0 || r.RPCCode != "OutOfRange" || r.Subject != "Watch" {
+		t.Errorf("%+v", r)
+	}
+	// messages are 2 bytes longer than their strings
+	if r.RequestMessages != 2 || r.ContentLength != 7 || r.ResponseMessages != 2 || r.ResponseLength != 10 {
+		t.Errorf("received %d messages of %d bytes, sent %d of %d", r.RequestMessages, r.ContentLength, r.ResponseMessages, r.ResponseLength)
+	}
+}
@@ -0,0 +1,51 @@
+package ECMSLogger
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// captureHeaders copies allowlisted headers. Headers from redact list are
+// masked completely, the rest go through the configured redactor.
+func (s *settings) captureHeaders(h http.Header, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(names))
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		vals, ok := h[key]
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		if headerInList(key, s.headers.Redact) {
+			res[key] = s.redactor.Replacement()
+			continue
+		}
+		res[key] = strings.Join(s.redactor.HeaderValues(key, vals), ", ")
+	}
+	return res
+}
+
+func headerInList(key string, list []string) bool {
+	for _, l := range list {
+		if strings.EqualFold(key, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func flattenHeaders(h map[string]string) ([]string, []string) {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	values := make([]string, len(names))
+	for i, k := range names {
+		values[i] = h[k]
+	}
+	return names, values
+}
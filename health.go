@@ -0,0 +1,167 @@
+package ECMSLogger
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthOK        = "ok"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+
+	defaultHealthPath    = "/health"
+	defaultHealthTimeout = time.Second
+)
+
+var defaultHealthThresholds = HealthThresholds{
+	FlushAge:    DurationThreshold{Degraded: time.Minute, Unhealthy: 5 * time.Minute},
+	QueueFill:   RatioThreshold{Degraded: 0.5, Unhealthy: 0.9},
+	ReserveFill: RatioThreshold{Degraded: 0.5, Unhealthy: 0.9},
+	GeoIPAge:    DurationThreshold{Degraded: 30 * 24 * time.Hour, Unhealthy: 90 * 24 * time.Hour},
+}
+
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name, status, message string) {
+	r.Checks = append(r.Checks, HealthCheck{Name: name, Status: status, Message: message})
+	if healthRank(status) > healthRank(r.Status) {
+		r.Status = status
+	}
+}
+
+func healthRank(status string) int {
+	switch status {
+	case HealthUnhealthy:
+		return 2
+	case HealthDegraded:
+		return 1
+	}
+	return 0
+}
+
+func (t DurationThreshold) status(d time.Duration) string {
+	switch {
+	case t.Unhealthy > 0 && d >= t.Unhealthy:
+		return HealthUnhealthy
+	case t.Degraded > 0 && d >= t.Degraded:
+		return HealthDegraded
+	}
+	return HealthOK
+}
+
+func (t RatioThreshold) status(r float64) string {
+	switch {
+	case t.Unhealthy > 0 && r >= t.Unhealthy:
+		return HealthUnhealthy
+	case t.Degraded > 0 && r >= t.Degraded:
+		return HealthDegraded
+	}
+	return HealthOK
+}
+
+func (hc *HealthConf) thresholds() HealthThresholds {
+	t := hc.Thresholds
+	d := defaultHealthThresholds
+	if t.FlushAge == (DurationThreshold{}) {
+		t.FlushAge = d.FlushAge
+	}
+	if t.QueueFill == (RatioThreshold{}) {
+		t.QueueFill = d.QueueFill
+	}
+	if t.ReserveFill == (RatioThreshold{}) {
+		t.ReserveFill = d.ReserveFill
+	}
+	if t.GeoIPAge == (DurationThreshold{}) {
+		t.GeoIPAge = d.GeoIPAge
+	}
+	return t
+}
+
+// Health reports state of the logger: ClickHouse connectivity, time since
+// the last successful flush, queue fill ratio, reserve dir usage and age of
+// the GeoIP database
+func (m *Middleware) Health() HealthReport {
+	hc := m.settings().health
+	t := hc.thresholds()
+	report := HealthReport{Status: HealthOK}
+
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthTimeout
+	}
+	// nil when records go only to sinks
+	if l := m.Logger; l != nil {
+		if db := l.db(); db == nil {
+			// records go to reserve dir while connecting
+			if l.reserve != nil {
+				report.add("clickhouse", HealthDegraded, "not connected, reserving")
+			} else {
+				report.add("clickhouse", HealthUnhealthy, "not connected")
+			}
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := db.PingContext(ctx)
+			cancel()
+			if err != nil {
+				report.add("clickhouse", HealthUnhealthy, err.Error())
+			} else {
+				report.add("clickhouse", HealthOK, "")
+			}
+		}
+
+		age := time.Since(l.LastFlush())
+		report.add("flush", t.FlushAge.status(age), "last successful flush "+age.Truncate(time.Second).String()+" ago")
+
+		if c := cap(l.records); c > 0 {
+			fill := float64(len(l.records)) / float64(c)
+			report.add("queue", t.QueueFill.status(fill), fmt.Sprintf("%d of %d", len(l.records), c))
+		}
+
+		if l.reserve != nil && l.reserve.maxTotalSize > 0 {
+			files, bytes := l.reserve.usage()
+			limit := l.reserve.maxTotalSize
+			fill := float64(bytes) / float64(limit)
+			report.add("reserve", t.ReserveFill.status(fill), fmt.Sprintf("%d files, %d of %d bytes", files, bytes, limit))
+		}
+	}
+
+	if m.MaxMind != nil {
+		built := time.Unix(int64(m.MaxMind.Metadata().BuildEpoch), 0)
+		age := time.Since(built)
+		report.add("geoip", t.GeoIPAge.status(age), "built "+built.UTC().Format(time.RFC3339))
+	}
+	return report
+}
+
+func (m *Middleware) healthHandler(c echo.Context) error {
+	report := m.Health()
+	code := http.StatusOK
+	if report.Status == HealthUnhealthy {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, report)
+}
+
+// LastFlush is the time of the last successful flush or of the last period
+// when the queue was empty and ClickHouse connected
+func (l *Logger) LastFlush() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&l.lastFlush))
+}
+
+func (l *Logger) markFlushed() {
+	atomic.StoreInt64(&l.lastFlush, time.Now().UnixNano())
+}
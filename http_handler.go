@@ -0,0 +1,110 @@
+package ECMSLogger
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// JSON responses bigger than this are not stored in the record
+const maxCapturedBody = 1 << 20
+
+// responseWriter records the status and size of a response. Flush, Hijack
+// and Push reach the wrapped writer, so streaming and websocket handlers work
+// behind the handler.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+	wroteBody   bool
+	hijacked    bool
+	capture     bool
+	body        bytes.Buffer
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+		w.capture = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	w.wroteBody = w.wroteBody || len(b) > 0
+	if w.capture {
+		if w.body.Len()+n > maxCapturedBody {
+			w.capture = false
+			w.body.Reset()
+		} else {
+			w.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over, e.g. for a websocket. The request is
+// logged with 101 unless a status was written before.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	if !w.wroteHeader {
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, nil
+}
+
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ClickhouseHandler is the net/http counterpart of ClickhouseMiddleware. It
+// works with any router accepting func(http.Handler) http.Handler, chi
+// included. Handlers reach the record with FromContext(r.Context()). Like
+// NoContent of the echo context, responses without body are logged only
+// with aux.Server.LogNoContent.
+func (m *Middleware) ClickhouseHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := m.newRequestLog(r, w.Header())
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(NewContext(r.Context(), l)))
+		if !rw.wroteBody && !rw.hijacked && !aux.Server.LogNoContent {
+			return
+		}
+		if rw.capture && rw.body.Len() > 0 {
+			l.record.Response = strings.TrimSuffix(rw.body.String(), "\n")
+		}
+		l.finish(rw.status, rw.size, w.Header())
+	})
+}
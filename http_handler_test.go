@@ -0,0 +1,152 @@
+package ECMSLogger
+
+import (
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSink keeps records sent to it
+type recordSink struct {
+	mu      sync.Mutex
+	records []AccessRecord
+}
+
+func (s *recordSink) Send(ar AccessRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, ar)
+}
+
+func (s *recordSink) Close() error {
+	return nil
+}
+
+// testMiddleware returns a middleware without databases which sends records
+// to the returned sink
+func testMiddleware(t *testing.T) (*Middleware, *recordSink) {
+	aux.Store = sessions.NewCookieStore([]byte("test"))
+	config := &Config{}
+	config.Headers.Request = []string{"Accept"}
+	config.Headers.Response = []string{"X-Custom"}
+	config.Bots.Disabled = true
+	m := &Middleware{SessionField: "nickname", stats: newMetrics(nil)}
+	s, err := m.newSettings(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.live = s
+	sink := &recordSink{}
+	m.Sinks = []Sink{sink}
+	return m, sink
+}
+
+// normalized clears fields which differ between two requests
+func normalized(records []AccessRecord) []AccessRecord {
+	res := make([]AccessRecord, len(records))
+	for i, r := range records {
+		r.Time, r.ClientTime = time.Time{}, time.Time{}
+		r.DurationUs, r.RedisDurationUs = 0, 0
+		r.SpanID = ""
+		res[i] = r
+	}
+	return res
+}
+
+func TestHandlerAdaptersRecordTheSame(t *testing.T) {
+	body := map[string]interface{}{"items": []string{"a", "b"}, "total": 2}
+	for _, tc := range []struct {
+		name   string
+		status int
+		// nil for a response without body
+		body interface{}
+	}{
+		{"json", http.StatusOK, body},
+		{"created", http.StatusCreated, map[string]string{"id": "42"}},
+		{"no content", http.StatusNoContent, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/v1/users/list/all?page=2&size=10", nil)
+				req.Header.Set("Accept", "application/json")
+				req.Header.Set("User-Agent", "test-client/1.0")
+				req.Header.Set("X-Request-ID", "request-1")
+				req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+				return req
+			}
+
+			echoMiddleware, echoSink := testMiddleware(t)
+			e := echo.New()
+			e.POST("/*", echoMiddleware.ClickhouseMiddleware(func(c echo.Context) error {
+				c.Response().Header().Set("X-Custom", "yes")
+				if tc.body == nil {
+					return c.NoContent(tc.status)
+				}
+				return c.JSON(tc.status, tc.body)
+			}))
+			e.ServeHTTP(httptest.NewRecorder(), newRequest())
+
+			httpMiddleware, httpSink := testMiddleware(t)
+			handler := httpMiddleware.ClickhouseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Custom", "yes")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				if tc.body != nil {
+					json.NewEncoder(w).Encode(tc.body)
+				}
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), newRequest())
+
+			got, want := normalized(httpSink.records), normalized(echoSink.records)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("net/http %+v\necho %+v", got, want)
+			}
+			if tc.body != nil && len(got) != 1 {
+				t.Errorf("%d records", len(got))
+			}
+		})
+	}
+}
+
+func TestHandlerWithoutRequestURI(t *testing.T) {
+	m, sink := testMiddleware(t)
+	handler := m.ClickhouseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/v2/orders/7", nil)
+	req.RequestURI = ""
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if len(sink.records) != 1 {
+		t.Fatalf("%d records", len(sink.records))
+	}
+	r := sink.records[0]
+	if r.RequestURI != "/v2/orders/7" || r.Version != "v2" || r.Category != "orders" || r.Subject != "7" {
+		t.Errorf("%+v", r)
+	}
+}
+
+func TestResponseWriterInterfaces(t *testing.T) {
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = &responseWriter{ResponseWriter: rec}
+	if _, ok := w.(http.Flusher); !ok {
+		t.Error("not a Flusher")
+	}
+	if _, _, err := w.(http.Hijacker).Hijack(); err != http.ErrNotSupported {
+		t.Errorf("hijack of a recorder: %v", err)
+	}
+	if err := w.(http.Pusher).Push("/style.css", nil); err != http.ErrNotSupported {
+		t.Errorf("push to a recorder: %v", err)
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		t.Error(err)
+	}
+	if !rec.Flushed {
+		t.Error("not flushed")
+	}
+}
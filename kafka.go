@@ -0,0 +1,355 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KafkaSink produces records to a Kafka topic in batches, e.g. for the Kafka
+// table engine of ClickHouse which merges inserts of many pods into big
+// parts. Batches which were not acknowledged after retries and records which
+// did not fit into the queue go to the reserve dir when it is configured.
+type KafkaSink struct {
+	conf    *KafkaSinkConf
+	format  recordFormatter
+	key     int
+	client  *kgo.Client
+	reserve *reserveWriter
+	metrics *Metrics
+	log     *log.Entry
+	records chan AccessRecord
+
+	// records which did not fit into the queue, reserved by run
+	overflowMu sync.Mutex
+	overflow   []AccessRecord
+	// records dropped since the last warning
+	overflowDropped int
+
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+}
+
+var kafkaAcks = map[string]kgo.Acks{"all": kgo.AllISRAcks(), "leader": kgo.LeaderAck(), "none": kgo.NoAck()}
+
+var kafkaCompression = map[string]kgo.CompressionCodec{
+	"none":   kgo.NoCompression(),
+	"gzip":   kgo.GzipCompression(),
+	"snappy": kgo.SnappyCompression(),
+	"lz4":    kgo.Lz4Compression(),
+	"zstd":   kgo.ZstdCompression(),
+}
+
+// kafkaKeyField returns the AccessRecord field of a key column, -1 for "-".
+// Header maps cannot be keys.
+func kafkaKeyField(column string) (int, error) {
+	if column == "-" {
+		return -1, nil
+	}
+	t := reflect.TypeOf(AccessRecord{})
+	for _, c := range kafkaColumns() {
+		if c.name == column && t.Field(c.index).Type.Kind() != reflect.Map {
+			return c.index, nil
+		}
+	}
+	return 0, errors.New("Unknown kafka key column: " + column)
+}
+
+// newKafkaTLS loads certificates of the tls section
+func newKafkaTLS(t *KafkaTLS) (*tls.Config, error) {
+	c := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in " + t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func newKafkaSASL(s *KafkaSASL) (sasl.Mechanism, error) {
+	switch strings.ToLower(s.Mechanism) {
+	case "plain":
+		return plain.Auth{User: s.User, Pass: s.Password}.AsMechanism(), nil
+	case "scram-sha-256":
+		return scram.Auth{User: s.User, Pass: s.Password}.AsSha256Mechanism(), nil
+	case "scram-sha-512":
+		return scram.Auth{User: s.User, Pass: s.Password}.AsSha512Mechanism(), nil
+	}
+	return nil, errors.New("Unknown SASL mechanism: " + s.Mechanism)
+}
+
+// newKafkaClient creates a producer with the settings of a validated sink
+// config. A record fails after retries attempts or when it is not
+// acknowledged within timeout per attempt.
+func newKafkaClient(conf *KafkaSinkConf) (*kgo.Client, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(conf.Brokers...),
+		kgo.ClientID(conf.ClientID),
+		kgo.DefaultProduceTopic(conf.Topic),
+		kgo.RequiredAcks(kafkaAcks[conf.Acks]),
+		kgo.ProducerBatchCompression(kafkaCompression[conf.Compression]),
+		kgo.DialTimeout(conf.Timeout),
+		kgo.ProduceRequestTimeout(conf.Timeout),
+		kgo.RecordRetries(conf.Retries),
+		kgo.RecordDeliveryTimeout(time.Duration(conf.Retries+1) * conf.Timeout),
+	}
+	if !conf.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if conf.TLS != nil {
+		c, err := newKafkaTLS(conf.TLS)
+		if err != nil {
+			return nil, errors.New("Wrong kafka tls: " + err.Error())
+		}
+		opts = append(opts, kgo.DialTLSConfig(c))
+	}
+	if conf.SASL != nil {
+		m, err := newKafkaSASL(conf.SASL)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.SASL(m))
+	}
+	return kgo.NewClient(opts...)
+}
+
+func newKafkaSink(conf *KafkaSinkConf, metrics *Metrics) (*KafkaSink, error) {
+	format, err := newKafkaFormatter(conf.Format)
+	if err != nil {
+		return nil, err
+	}
+	key, err := kafkaKeyField(conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	s := &KafkaSink{
+		conf:    conf,
+		format:  format,
+		key:     key,
+		metrics: metrics,
+		log:     log.WithField("topic", conf.Topic),
+		records: make(chan AccessRecord, conf.QueueSize),
+		done:    make(chan struct{}),
+	}
+	if conf.Reserve != nil {
+		if s.reserve, err = newReserveWriter(conf.Reserve, s.log); err != nil {
+			return nil, err
+		}
+		s.reserve.metrics = metrics
+	}
+	if s.client, err = newKafkaClient(conf); err != nil {
+		s.reserve.close()
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queues the record. When the queue is full the record goes to the
+// reserve with the next flush, or is dropped without reserve.
+func (s *KafkaSink) Send(ar AccessRecord) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		s.metrics.observeDropped("closed", 1)
+		return
+	}
+	select {
+	case s.records <- ar:
+	default:
+		s.spill(ar)
+	}
+}
+
+// spill keeps a record which did not fit into the queue, up to queueSize
+// of them wait for the next flush
+func (s *KafkaSink) spill(ar AccessRecord) {
+	s.overflowMu.Lock()
+	defer s.overflowMu.Unlock()
+	if s.reserve != nil && len(s.overflow) < s.conf.QueueSize {
+		s.overflow = append(s.overflow, ar)
+		return
+	}
+	s.overflowDropped++
+	s.metrics.observeDropped("kafka_queue_full", 1)
+}
+
+// reserveOverflow writes records which did not fit into the queue to the
+// reserve and reports dropped ones
+func (s *KafkaSink) reserveOverflow() {
+	s.overflowMu.Lock()
+	records, dropped := s.overflow, s.overflowDropped
+	s.overflow, s.overflowDropped = nil, 0
+	s.overflowMu.Unlock()
+	if dropped > 0 {
+		s.log.Warning("Queue is full, dropped ", dropped, " records")
+	}
+	if len(records) > 0 {
+		s.log.Warning("Queue is full, reserving ", len(records), " records")
+		s.reserve.write(records)
+	}
+}
+
+// Close produces queued records and closes connections
+func (s *KafkaSink) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.records)
+	s.closeMu.Unlock()
+	<-s.done
+	s.client.Close()
+	s.reserve.close()
+	return nil
+}
+
+func (s *KafkaSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.conf.Period)
+	defer ticker.Stop()
+	batch := make([]AccessRecord, 0, s.conf.BatchSize)
+	for {
+		select {
+		case ar, ok := <-s.records:
+			if !ok {
+				s.flush(batch)
+				s.reserveOverflow()
+				return
+			}
+			batch = append(batch, ar)
+			if len(batch) >= s.conf.BatchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+			s.reserveOverflow()
+		}
+	}
+}
+
+// messages formats records, the ones which cannot be formatted are left
+// out and counted in failed. index maps messages to records of the batch.
+func (s *KafkaSink) messages(batch []AccessRecord) (messages []*kgo.Record, index map[*kgo.Record]int, failed int, err error) {
+	messages = make([]*kgo.Record, 0, len(batch))
+	index = make(map[*kgo.Record]int, len(batch))
+	var buf bytes.Buffer
+	for i := range batch {
+		buf.Reset()
+		if ferr := s.format(&buf, &batch[i]); ferr != nil {
+			failed, err = failed+1, ferr
+			continue
+		}
+		m := &kgo.Record{Value: append([]byte{}, buf.Bytes()...), Timestamp: batch[i].Time}
+		if s.key >= 0 {
+			if k := formatValue(reflect.ValueOf(batch[i]).Field(s.key)); k != "" {
+				m.Key = []byte(k)
+			}
+		}
+		if m.Timestamp.IsZero() {
+			m.Timestamp = time.Now()
+		}
+		messages = append(messages, m)
+		index[m] = i
+	}
+	return messages, index, failed, err
+}
+
+// flush produces a batch, undelivered records go to the reserve
+func (s *KafkaSink) flush(batch []AccessRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	messages, index, n, err := s.messages(batch)
+	if n > 0 {
+		s.log.Error(err)
+		s.metrics.observeDropped("kafka_failed", n)
+	}
+	if len(messages) == 0 {
+		return
+	}
+	records := []AccessRecord{}
+	for _, r := range s.client.ProduceSync(context.Background(), messages...) {
+		if r.Err != nil {
+			err = r.Err
+			records = append(records, batch[index[r.Record]])
+		}
+	}
+	if len(records) == 0 {
+		err = nil
+	}
+	s.metrics.observeProduced(len(messages)-len(records), err)
+	if len(records) == 0 {
+		return
+	}
+	s.log.Error("Cannot produce ", len(records), " records: ", err)
+	if s.reserve == nil {
+		s.metrics.observeDropped("kafka_failed", len(records))
+		return
+	}
+	s.reserve.write(records)
+}
+
+// ProduceRecords produces records with the settings of a Kafka sink and
+// waits for acknowledgement, e.g. to replay its reserve dir. The reserve of
+// conf is not used.
+func ProduceRecords(conf *KafkaSinkConf, records []AccessRecord) error {
+	format, err := newKafkaFormatter(conf.Format)
+	if err != nil {
+		return err
+	}
+	key, err := kafkaKeyField(conf.Key)
+	if err != nil {
+		return err
+	}
+	s := &KafkaSink{conf: conf, format: format, key: key}
+	messages, _, n, err := s.messages(records)
+	if n > 0 {
+		return err
+	}
+	client, err := newKafkaClient(conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	failed := 0
+	for _, r := range client.ProduceSync(context.Background(), messages...) {
+		if r.Err != nil {
+			failed, err = failed+1, r.Err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d records are not produced: %v", failed, len(records), err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Formats of Kafka messages, one record per message. json is JSONEachRow
+// and protobuf is ProtobufSingle for the Kafka table engine of ClickHouse.
+const (
+	KafkaFormatJSON     = "json"
+	KafkaFormatProtobuf = "protobuf"
+
+	// KafkaProtoMessage is the message name in the schema of KafkaProtoSchema
+	KafkaProtoMessage = "AccessRecord"
+)
+
+// kafkaProtoFields number fields of the protobuf message by position. The
+// list is append only: consumers keep schemas of older versions.
+var kafkaProtoFields = []string{
+	"time", "client_time", "kind", "request_id", "trace_id", "span_id", "parent_span_id", "trace_state",
+	"region", "location", "host", "method", "request_uri", "version", "category", "subject",
+	"remote_addr", "content_length", "os", "os_version", "browser", "browser_version", "device_type",
+	"is_bot", "bot_name", "bot_verified", "continent", "country", "iso_country", "city", "subdivision",
+	"timezone", "duration_us", "redis_duration_us", "db_duration_us", "db_queries", "db_slowest_us",
+	"db_slowest_query", "redis_calls", "longitude", "latitude", "accuracy_radius", "eu_member", "width",
+	"height", "user", "user_agent", "source", "target", "params", "status", "response", "response_length",
+	"error", "rpc_code", "request_messages", "response_messages", "sample_rate", "branch", "commit_hash",
+	"tag", "client_name", "client_branch", "client_commit_hash", "client_tag", "request_headers",
+	"response_headers", "hosting_org",
+}
+
+type kafkaColumn struct {
+	name string
+	// index of the AccessRecord field
+	index int
+}
+
+// kafkaColumns maps column names to AccessRecord fields in declaration order
+func kafkaColumns() []kafkaColumn {
+	t := reflect.TypeOf(AccessRecord{})
+	columns := []kafkaColumn{}
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("db"); name != "" && name != "-" {
+			columns = append(columns, kafkaColumn{name: name, index: i})
+		}
+	}
+	return columns
+}
+
+func newKafkaFormatter(format string) (recordFormatter, error) {
+	switch format {
+	case KafkaFormatJSON, "":
+		return formatJSONEachRow, nil
+	case KafkaFormatProtobuf:
+		return newProtobufFormatter(), nil
+	}
+	return nil, errors.New("Unknown kafka format: " + format)
+}
+
+// formatJSONEachRow writes a row as ClickHouse parses it: column names as
+// keys, DateTime as unix seconds, bools as 0 and 1 and headers as objects
+func formatJSONEachRow(buf *bytes.Buffer, ar *AccessRecord) error {
+	v := reflect.ValueOf(ar).Elem()
+	buf.WriteByte('{')
+	for i, c := range kafkaColumns() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		var value interface{}
+		switch f := v.Field(c.index).Interface().(type) {
+		case time.Time:
+			value = f.Unix()
+			if f.IsZero() {
+				value = 0
+			}
+		case bool:
+			value = 0
+			if f {
+				value = 1
+			}
+		case map[string]string:
+			// null is not a Map
+			if f == nil {
+				f = map[string]string{}
+			}
+			value = f
+		default:
+			value = f
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, `"%s":%s`, c.name, b)
+	}
+	buf.WriteString("}\n")
+	return nil
+}
+
+// protoType is the protobuf type of a column, DateTime is sent as uint32
+// unix seconds, bools as UInt8 and headers as map for Map columns
+func protoType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "bool"
+	case reflect.Float64:
+		return "double"
+	case reflect.Int64:
+		return "int64"
+	case reflect.Uint64:
+		return "uint64"
+	case reflect.Uint16, reflect.Uint32:
+		return "uint32"
+	case reflect.Map:
+		return "map<string, string>"
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return "uint32"
+		}
+	}
+	return ""
+}
+
+type protoField struct {
+	number int
+	column kafkaColumn
+	typ    string
+}
+
+func protoFields() []protoField {
+	columns := map[string]kafkaColumn{}
+	for _, c := range kafkaColumns() {
+		columns[c.name] = c
+	}
+	t := reflect.TypeOf(AccessRecord{})
+	fields := []protoField{}
+	for i, name := range kafkaProtoFields {
+		c, ok := columns[name]
+		if !ok {
+			continue
+		}
+		fields = append(fields, protoField{number: i + 1, column: c, typ: protoType(t.Field(c.index).Type)})
+	}
+	return fields
+}
+
+// KafkaProtoSchema returns the .proto file for format_schema of the Kafka
+// table engine, e.g. format_schema = 'access.proto:AccessRecord'
+func KafkaProtoSchema() string {
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\n")
+	b.WriteString("message " + KafkaProtoMessage + " {\n")
+	for _, f := range protoFields() {
+		fmt.Fprintf(&b, "  %s %s = %d;\n", f.typ, f.column.name, f.number)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// newProtobufFormatter writes a message of KafkaProtoSchema, zero values are
+// left out as proto3 does
+func newProtobufFormatter() recordFormatter {
+	fields := protoFields()
+	return func(buf *bytes.Buffer, ar *AccessRecord) error {
+		v := reflect.ValueOf(ar).Elem()
+		var b []byte
+		for _, f := range fields {
+			number := protowire.Number(f.number)
+			field := v.Field(f.column.index)
+			if field.IsZero() {
+				continue
+			}
+			switch x := field.Interface().(type) {
+			case map[string]string:
+				// an entry is a message of key = 1 and value = 2
+				names, values := flattenHeaders(x)
+				for i := range names {
+					var e []byte
+					e = protowire.AppendTag(e, 1, protowire.BytesType)
+					e = protowire.AppendString(e, names[i])
+					e = protowire.AppendTag(e, 2, protowire.BytesType)
+					e = protowire.AppendString(e, values[i])
+					b = protowire.AppendTag(b, number, protowire.BytesType)
+					b = protowire.AppendBytes(b, e)
+				}
+			case string:
+				b = protowire.AppendTag(b, number, protowire.BytesType)
+				b = protowire.AppendString(b, x)
+			case bool:
+				b = protowire.AppendTag(b, number, protowire.VarintType)
+				b = protowire.AppendVarint(b, protowire.EncodeBool(x))
+			case float64:
+				b = protowire.AppendTag(b, number, protowire.Fixed64Type)
+				b = protowire.AppendFixed64(b, math.Float64bits(x))
+			case int64:
+				b = protowire.AppendTag(b, number, protowire.VarintType)
+				b = protowire.AppendVarint(b, uint64(x))
+			case time.Time:
+				b = protowire.AppendTag(b, number, protowire.VarintType)
+				b = protowire.AppendVarint(b, uint64(uint32(x.Unix())))
+			default:
+				b = protowire.AppendTag(b, number, protowire.VarintType)
+				b = protowire.AppendVarint(b, field.Uint())
+			}
+		}
+		buf.Write(b)
+		return nil
+	}
+}
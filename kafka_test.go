@@ -0,0 +1,268 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"google.golang.org/protobuf/encoding/protowire"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKafkaCluster(t *testing.T, opts ...kfake.Opt) *kfake.Cluster {
+	c, err := kfake.NewCluster(append([]kfake.Opt{kfake.NumBrokers(1), kfake.SeedTopics(3, "access")}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testKafkaSink starts a sink producing to cluster, conf is completed with
+// defaults
+func testKafkaSink(t *testing.T, cluster *kfake.Cluster, conf KafkaSinkConf) *KafkaSink {
+	conf.Brokers = cluster.ListenAddrs()
+	conf.Topic = "access"
+	c := &Config{Sinks: Sinks{Kafka: &conf}}
+	errs := ValidationErrors{}
+	c.validateKafkaSink(&errs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	s, err := newKafkaSink(c.Sinks.Kafka, newMetrics(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// sendRecords sends n records with 5 distinct request ids and closes the
+// sink, which produces what is queued
+func sendRecords(t *testing.T, s *KafkaSink, n int) {
+	for i := 0; i < n; i++ {
+		s.Send(AccessRecord{RequestID: fmt.Sprint("request-", i%5), Status: uint16(i)})
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// consume reads n messages of the topic
+func consume(t *testing.T, cluster *kfake.Cluster, n int, opts ...kgo.Opt) []*kgo.Record {
+	client, err := kgo.NewClient(append(opts, kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.ConsumeTopics("access"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	records := []*kgo.Record{}
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("%d of %d messages", len(records), n)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaSinkKeyedBatches(t *testing.T) {
+	cluster := testKafkaCluster(t)
+	defer cluster.Close()
+	sendRecords(t, testKafkaSink(t, cluster, KafkaSinkConf{Idempotent: true, BatchSize: 10}), 25)
+	partitions := map[string]int32{}
+	statuses := map[string][]int{}
+	for _, m := range consume(t, cluster, 25) {
+		var row struct {
+			RequestID string `json:"request_id"`
+			Status    int    `json:"status"`
+		}
+		if err := json.Unmarshal(m.Value, &row); err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Key) != row.RequestID {
+			t.Errorf("key %q of %s", m.Key, m.Value)
+		}
+		if p, ok := partitions[row.RequestID]; ok && p != m.Partition {
+			t.Errorf("%s went to partitions %d and %d", m.Key, p, m.Partition)
+		}
+		partitions[row.RequestID] = m.Partition
+		statuses[row.RequestID] = append(statuses[row.RequestID], row.Status)
+	}
+	// records of a key keep their order
+	for key, st := range statuses {
+		for i := 1; i < len(st); i++ {
+			if st[i] <= st[i-1] {
+				t.Errorf("%s: %v", key, st)
+			}
+		}
+	}
+}
+
+// failProduce answers every produce request with code
+func failProduce(cluster *kfake.Cluster, code int16) {
+	cluster.ControlKey(int16(kmsg.Produce), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		r := req.(*kmsg.ProduceRequest)
+		resp := r.ResponseKind().(*kmsg.ProduceResponse)
+		for _, topic := range r.Topics {
+			rt := kmsg.NewProduceResponseTopic()
+			rt.Topic = topic.Topic
+			for _, p := range topic.Partitions {
+				rp := kmsg.NewProduceResponseTopicPartition()
+				rp.Partition = p.Partition
+				rp.ErrorCode = code
+				rt.Partitions = append(rt.Partitions, rp)
+			}
+			resp.Topics = append(resp.Topics, rt)
+		}
+		return resp, nil, true
+	})
+}
+
+func readReserve(t *testing.T, dir string) []AccessRecord {
+	files, err := ReserveFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []AccessRecord{}
+	for _, f := range files {
+		rf, err := ReadReserveFile(f, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rf.Records...)
+	}
+	return records
+}
+
+func TestKafkaSinkReserve(t *testing.T) {
+	dir := testReserveDir(t)
+	defer os.RemoveAll(dir)
+	cluster := testKafkaCluster(t)
+	defer cluster.Close()
+	failProduce(cluster, kerr.NotEnoughReplicas.Code)
+	s := testKafkaSink(t, cluster, KafkaSinkConf{
+		BatchSize: 10,
+		Retries:   1,
+		Reserve:   &Reserve{Dir: dir, Rotate: RotateConf{MaxFiles: 10, MaxSize: "1m"}},
+	})
+	sendRecords(t, s, 7)
+	records := readReserve(t, dir)
+	if len(records) != 7 {
+		t.Fatalf("reserved %+v", records)
+	}
+	seen := map[uint16]bool{}
+	for _, r := range records {
+		seen[r.Status] = true
+	}
+	if len(seen) != 7 {
+		t.Errorf("reserved %+v", records)
+	}
+}
+
+func TestKafkaSinkOverflow(t *testing.T) {
+	dir := testReserveDir(t)
+	defer os.RemoveAll(dir)
+	cluster := testKafkaCluster(t)
+	defer cluster.Close()
+	// the first produce waits until the queue overflows
+	received, release := make(chan struct{}), make(chan struct{})
+	cluster.ControlKey(int16(kmsg.Produce), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.DropControl()
+		close(received)
+		<-release
+		return nil, nil, false
+	})
+	s := testKafkaSink(t, cluster, KafkaSinkConf{
+		BatchSize: 1,
+		QueueSize: 2,
+		Reserve:   &Reserve{Dir: dir, Rotate: RotateConf{MaxFiles: 10, MaxSize: "1m"}},
+	})
+	s.Send(AccessRecord{Status: 0})
+	<-received
+	for i := 1; i < 10; i++ {
+		s.Send(AccessRecord{Status: uint16(i)})
+	}
+	close(release)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the first record is produced, two wait in the queue, two more wait for
+	// the reserve and the rest is dropped
+	consume(t, cluster, 3)
+	records := readReserve(t, dir)
+	if len(records) != 2 || records[0].Status != 3 || records[1].Status != 4 {
+		t.Errorf("reserved %+v", records)
+	}
+	if n := s.metrics.dropped["kafka_queue_full"]; n != 5 {
+		t.Errorf("%d dropped", n)
+	}
+}
+
+func TestKafkaSinkSASL(t *testing.T) {
+	cluster := testKafkaCluster(t, kfake.EnableSASL(), kfake.Superuser("SCRAM-SHA-256", "logger", "secret"))
+	defer cluster.Close()
+	s := testKafkaSink(t, cluster, KafkaSinkConf{
+		SASL: &KafkaSASL{Mechanism: "scram-sha-256", User: "logger", Password: "secret"},
+	})
+	sendRecords(t, s, 3)
+	consume(t, cluster, 3, kgo.SASL(scram.Auth{User: "logger", Pass: "secret"}.AsSha256Mechanism()))
+}
+
+func TestKafkaFormatHeaders(t *testing.T) {
+	ar := AccessRecord{RequestHeaders: map[string]string{"Accept": "text/html", "Accept-Encoding": "gzip"}}
+	var buf bytes.Buffer
+	if err := formatJSONEachRow(&buf, &ar); err != nil {
+		t.Fatal(err)
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &row); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"Accept": "text/html", "Accept-Encoding": "gzip"}
+	if !reflect.DeepEqual(row["request_headers"], want) || !reflect.DeepEqual(row["response_headers"], map[string]interface{}{}) {
+		t.Errorf("request %v, response %v", row["request_headers"], row["response_headers"])
+	}
+
+	schema := KafkaProtoSchema()
+	for _, s := range []string{"map<string, string> request_headers = 66;", "map<string, string> response_headers = 67;"} {
+		if !strings.Contains(schema, s) {
+			t.Errorf("%s is not in\n%s", s, schema)
+		}
+	}
+	buf.Reset()
+	if err := newProtobufFormatter()(&buf, &ar); err != nil {
+		t.Fatal(err)
+	}
+	// map entries of field 66 in key order
+	got := []string{}
+	for b := buf.Bytes(); len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if num == 66 {
+			entry, _ := protowire.ConsumeBytes(b)
+			for len(entry) > 0 {
+				_, _, m := protowire.ConsumeTag(entry)
+				entry = entry[m:]
+				s, m := protowire.ConsumeString(entry)
+				entry = entry[m:]
+				got = append(got, s)
+			}
+		}
+		b = b[n:]
+	}
+	if want := []string{"Accept", "text/html", "Accept-Encoding", "gzip"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries %q", got)
+	}
+}
@@ -0,0 +1,293 @@
+package ECMSLogger
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+	// label values of requests outside of metricMethods and categories
+	otherMethod   = "OTHER"
+	otherCategory = "other"
+)
+
+var (
+	latencyBuckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	batchSizeBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+	// methods are sent by clients, so labels are limited to known ones
+	metricMethods = map[string]bool{
+		http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+		http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true, http.MethodConnect: true,
+		http.MethodTrace: true, grpcUnaryMethod: true, grpcStreamMethod: true,
+	}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), h.count)
+}
+
+// Metrics of the logging pipeline and of the logged requests. Rendered in
+// Prometheus text exposition format.
+type Metrics struct {
+	mu              sync.Mutex
+	batchSize       *histogram
+	flushDuration   *histogram
+	flushFailures   uint64
+	flushedRecords  uint64
+	reservedRecords uint64
+	evictedFiles    uint64
+	evictedRecords  uint64
+	kafkaRecords    uint64
+	kafkaFailures   uint64
+	dropped         map[string]uint64
+	requests        map[string]uint64
+	latency         map[string]*histogram
+	// allowed values of the category label
+	categories map[string]bool
+	logger     *Logger
+}
+
+func newMetrics(l *Logger) *Metrics {
+	return &Metrics{
+		logger:        l,
+		batchSize:     newHistogram(batchSizeBuckets),
+		flushDuration: newHistogram(latencyBuckets),
+		dropped:       make(map[string]uint64),
+		requests:      make(map[string]uint64),
+		latency:       make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) observeFlush(size int, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushDuration.observe(dur.Seconds())
+	if err != nil {
+		m.flushFailures++
+		return
+	}
+	m.batchSize.observe(float64(size))
+	m.flushedRecords += uint64(size)
+}
+
+// observeProduced counts records acknowledged by Kafka and batches which
+// were not delivered completely
+func (m *Metrics) observeProduced(n int, err error) {
+	m.mu.Lock()
+	m.kafkaRecords += uint64(n)
+	if err != nil {
+		m.kafkaFailures++
+	}
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observeReserved(n int) {
+	m.mu.Lock()
+	m.reservedRecords += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observeDropped(reason string, n int) {
+	m.mu.Lock()
+	m.dropped[reason] += uint64(n)
+	m.mu.Unlock()
+}
+
+// observeEvicted counts a reserve file deleted to make room, its records are
+// dropped too
+func (m *Metrics) observeEvicted(records int) {
+	m.mu.Lock()
+	m.evictedFiles++
+	m.evictedRecords += uint64(records)
+	m.dropped["reserve_evicted"] += uint64(records)
+	m.mu.Unlock()
+}
+
+// setCategories sets values of the category label, other categories are
+// counted as other
+func (m *Metrics) setCategories(categories []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.categories = map[string]bool{}
+	for _, c := range categories {
+		m.categories[c] = true
+	}
+}
+
+func (m *Metrics) observeRequest(ar *AccessRecord) {
+	kind := ar.Kind
+	if kind == "" {
+		kind = inboundKind
+	}
+	method := ar.Method
+	if !metricMethods[method] {
+		method = otherMethod
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// categories come from the request URI, unknown ones share a label
+	category := ar.Category
+	if category != "" && !m.categories[category] {
+		category = otherCategory
+	}
+	// gRPC records have a code name instead of HTTP status
+	status := ar.RPCCode
+	if status == "" {
+		status = strconv.Itoa(int(ar.Status))
+	}
+	route := labelPairs("kind", kind, "method", method, "category", category)
+	requests := labelPairs("kind", kind, "method", method, "category", category, "status", status)
+	m.requests[requests]++
+	h, ok := m.latency[route]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.latency[route] = h
+	}
+	h.observe(float64(ar.DurationUs) / 1e6)
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	queueLen, queueCap := 0, 0
+	var reserve *reserveWriter
+	if l := m.logger; l != nil {
+		queueLen, queueCap = len(l.records), cap(l.records)
+		reserve = l.reserve
+	}
+	files, bytes := reserve.usage()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writeHeader(w, "ecms_logger_queue_length", "gauge", "Records waiting to be flushed")
+	fmt.Fprintf(w, "ecms_logger_queue_length %d\n", queueLen)
+	writeHeader(w, "ecms_logger_queue_capacity", "gauge", "Capacity of the records queue")
+	fmt.Fprintf(w, "ecms_logger_queue_capacity %d\n", queueCap)
+	writeHeader(w, "ecms_logger_batch_size", "histogram", "Records per successful flush")
+	m.batchSize.write(w, "ecms_logger_batch_size", "")
+	writeHeader(w, "ecms_logger_flush_duration_seconds", "histogram", "Duration of flushes to ClickHouse")
+	m.flushDuration.write(w, "ecms_logger_flush_duration_seconds", "")
+	writeHeader(w, "ecms_logger_flush_failures_total", "counter", "Failed flushes to ClickHouse")
+	fmt.Fprintf(w, "ecms_logger_flush_failures_total %d\n", m.flushFailures)
+	writeHeader(w, "ecms_logger_flushed_records_total", "counter", "Records written to ClickHouse")
+	fmt.Fprintf(w, "ecms_logger_flushed_records_total %d\n", m.flushedRecords)
+	writeHeader(w, "ecms_logger_reserved_records_total", "counter", "Records written to reserve dir")
+	fmt.Fprintf(w, "ecms_logger_reserved_records_total %d\n", m.reservedRecords)
+	writeHeader(w, "ecms_logger_reserve_files", "gauge", "Files in reserve dir")
+	fmt.Fprintf(w, "ecms_logger_reserve_files %d\n", files)
+	writeHeader(w, "ecms_logger_reserve_bytes", "gauge", "Size of files in reserve dir")
+	fmt.Fprintf(w, "ecms_logger_reserve_bytes %d\n", bytes)
+	writeHeader(w, "ecms_logger_reserve_evicted_files_total", "counter", "Reserve files deleted to make room")
+	fmt.Fprintf(w, "ecms_logger_reserve_evicted_files_total %d\n", m.evictedFiles)
+	writeHeader(w, "ecms_logger_reserve_evicted_records_total", "counter", "Records of reserve files deleted to make room")
+	fmt.Fprintf(w, "ecms_logger_reserve_evicted_records_total %d\n", m.evictedRecords)
+	writeHeader(w, "ecms_logger_kafka_produced_records_total", "counter", "Records acknowledged by Kafka")
+	fmt.Fprintf(w, "ecms_logger_kafka_produced_records_total %d\n", m.kafkaRecords)
+	writeHeader(w, "ecms_logger_kafka_failures_total", "counter", "Batches not delivered to Kafka completely")
+	fmt.Fprintf(w, "ecms_logger_kafka_failures_total %d\n", m.kafkaFailures)
+	if r := reserve; r != nil {
+		if free, _, ok := diskSpace(r.conf.Dir); ok {
+			writeHeader(w, "ecms_logger_reserve_disk_free_bytes", "gauge", "Free space of the disk with reserve dir")
+			fmt.Fprintf(w, "ecms_logger_reserve_disk_free_bytes %d\n", free)
+		}
+	}
+	writeHeader(w, "ecms_logger_dropped_records_total", "counter", "Records which were not written anywhere")
+	for _, k := range sortedKeys(m.dropped) {
+		fmt.Fprintf(w, "ecms_logger_dropped_records_total{reason=\"%s\"} %d\n", escapeLabel(k), m.dropped[k])
+	}
+	writeHeader(w, "ecms_requests_total", "counter", "Requests seen by the logger, including sampled out")
+	for _, k := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "ecms_requests_total{%s} %d\n", k, m.requests[k])
+	}
+	writeHeader(w, "ecms_request_duration_seconds", "histogram", "Request latency")
+	routes := make([]string, 0, len(m.latency))
+	for k := range m.latency {
+		routes = append(routes, k)
+	}
+	sort.Strings(routes)
+	for _, k := range routes {
+		m.latency[k].write(w, "ecms_request_duration_seconds", k)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Write(w)
+}
+
+// MetricsHandler serves metrics of the logger in Prometheus text format
+func (m *Middleware) MetricsHandler() http.Handler {
+	return m.stats
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func labelPairs(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+"=\""+escapeLabel(kv[i+1])+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,37 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestObserveRequestLabels(t *testing.T) {
+	m := newMetrics(nil)
+	m.setCategories([]string{"users"})
+	for _, ar := range []AccessRecord{
+		{Method: "GET", Category: "users", Status: 200},
+		{Method: "GET", Category: "random-1", Status: 200},
+		{Method: "GET", Category: "random-2", Status: 200},
+		{Method: "FOO", Category: "users", Status: 405},
+		{Method: grpcUnaryMethod, Category: "pkg.Service", RPCCode: "NotFound"},
+	} {
+		ar := ar
+		m.observeRequest(&ar)
+	}
+	var buf bytes.Buffer
+	m.Write(&buf)
+	for _, want := range []string{
+		`ecms_requests_total{kind="inbound",method="GET",category="users",status="200"} 1`,
+		`ecms_requests_total{kind="inbound",method="GET",category="other",status="200"} 2`,
+		`ecms_requests_total{kind="inbound",method="OTHER",category="users",status="405"} 1`,
+		`ecms_requests_total{kind="inbound",method="GRPC",category="other",status="NotFound"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("no %s in\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "random") || strings.Contains(buf.String(), "FOO") {
+		t.Errorf("unbounded label in\n%s", buf.String())
+	}
+}
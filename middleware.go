@@ -3,88 +3,206 @@ package ECMSLogger
 import (
 	"encoding/json"
 	"errors"
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo/v4"
 	"github.com/oschwald/geoip2-golang"
-	log "github.com/sirupsen/logrus"
-	"net"
 	"net/http"
-	"strconv"
-	"strings"
-	"time"
+	"reflect"
+	"sync"
 )
 
-type ClickhouseMiddlewareConfig struct {
-	IPSource     string
-	MaxMind      *geoip2.Reader
-	Logger       Logger
+type Middleware struct {
+	IPSource string
+	MaxMind  *geoip2.Reader
+	// nil when clickhouse is disabled
+	Logger *Logger
+	// records go to Logger and every sink
+	Sinks        []Sink
 	SessionField string
 	Branch       string
 	CommitHash   string
 	Tag          string
+	// Resolver is used to verify crawlers, net.DefaultResolver if nil
+	Resolver    Resolver
+	Metrics     MetricsConf
+	Healthcheck HealthConf
+	// config the middleware was started or last reloaded with
+	config   *Config
+	stats    *Metrics
+	mu       sync.RWMutex
+	live     *settings
+	reloadMu sync.Mutex
 }
 
-var chMiddleware ClickhouseMiddlewareConfig
+// settings which can be replaced by Reload. A request takes them once, so it
+// is processed with the same settings from start to end.
+type settings struct {
+	headers         Headers
+	requestIDHeader string
+	redactor        *Redactor
+	uaParser        *UAParser
+	botClassifier   *BotClassifier
+	sampler         *Sampler
+	health          HealthConf
+}
 
-func (m *ClickhouseMiddlewareConfig) Init(config *Config) {
-	m.initMaxMind(&config.MaxMind)
-	m.Logger.Init(&config.Clickhouse)
+// NewMiddleware opens GeoIP databases, compiles rules and starts the logger.
+// ClickHouse is connected in background, so an unreachable server does not
+// fail the start.
+func NewMiddleware(config *Config) (*Middleware, error) {
+	m := &Middleware{}
+	if err := m.Init(config); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func (cm *ClickhouseMiddlewareConfig) initMaxMind(mm *MaxMind) {
-	tmp, err := geoip2.Open(mm.DB)
+// Init is NewMiddleware for a value with fields like Resolver or Branch set
+// in advance
+func (m *Middleware) Init(config *Config) error {
+	// a config built in code has no defaults yet
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if err := m.initMaxMind(&config.MaxMind); err != nil {
+		return err
+	}
+	s, err := m.newSettings(config, nil, nil)
 	if err != nil {
-		panic(err)
+		m.MaxMind.Close()
+		return err
 	}
-	cm.MaxMind = tmp
-	if v, ok := mm.Source["remoteAddr"]; ok && v == "true" {
-		cm.IPSource = "remoteAddr"
-	} else if v, ok := mm.Source["header"]; ok {
-		cm.IPSource = v
+	if config.Clickhouse.Disabled {
+		m.stats = newMetrics(nil)
 	} else {
-		panic("Undefined ip source for maxmind")
+		l, err := NewLogger(&config.Clickhouse)
+		if err != nil {
+			m.MaxMind.Close()
+			return err
+		}
+		m.Logger = l
+		m.stats = l.metrics
 	}
+	m.stats.setCategories(config.Metrics.Categories)
+	sinks, err := newSinks(&config.Sinks, m.stats)
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Close()
+		}
+		m.MaxMind.Close()
+		return err
+	}
+	m.Sinks = append(m.Sinks, sinks...)
+	m.Metrics = config.Metrics
+	m.Healthcheck = config.Health
+	m.config = config
+	m.live = s
+	return nil
 }
 
-type ClickhouseContext struct {
-	echo.Context
-	record       AccessRecord
-	sess         *sessions.Session
-	redisStatus  int
-	redisErr     error
-	accessStatus int
-	accessErr    error
+func (m *Middleware) settings() *settings {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.live
 }
 
-func (cs *ClickhouseContext) userNickname(ctx echo.Context) (string, *sessions.Session, int, error) {
-	sess, err := aux.Store.Get(ctx.Request(), aux.Session.Cookie)
-	if err != nil {
-		return "", nil, http.StatusInternalServerError, err
+// Close flushes queued records and releases databases
+func (m *Middleware) Close() error {
+	var err error
+	if m.Logger != nil {
+		err = m.Logger.Close()
 	}
-	interfaceId, ok := sess.Values[chMiddleware.SessionField]
-	if !ok {
-		return "", nil, http.StatusBadRequest, errors.New(chMiddleware.SessionField + " is not found")
+	for _, s := range m.Sinks {
+		if serr := s.Close(); err == nil {
+			err = serr
+		}
+	}
+	if m.MaxMind != nil {
+		m.MaxMind.Close()
 	}
-	nickname := interfaceId.(string)
-	if nickname == "" {
-		return "", nil, http.StatusTemporaryRedirect, errors.New(chMiddleware.SessionField + " is empty")
+	if s := m.settings(); s != nil {
+		s.botClassifier.Close()
 	}
-	if twofaId, ok := sess.Values["2fa"]; ok {
-		twofa := twofaId.(bool)
-		if !twofa {
-			return nickname, sess, http.StatusForbidden, errors.New("2FA has not finished")
+	return err
+}
+
+// RegisterRoutes adds service endpoints of the logger enabled in config
+func (m *Middleware) RegisterRoutes(e *echo.Echo) {
+	if m.Metrics.Enabled {
+		path := m.Metrics.Path
+		if path == "" {
+			path = defaultMetricsPath
 		}
+		e.GET(path, echo.WrapHandler(m.MetricsHandler()))
+	}
+	if m.Healthcheck.Enabled {
+		path := m.Healthcheck.Path
+		if path == "" {
+			path = defaultHealthPath
+		}
+		e.GET(path, m.healthHandler)
+	}
+}
+
+// newSettings builds settings from config. User agent parser and bot
+// classifier of prev are kept when their config has not changed, so their
+// caches survive a reload.
+func (m *Middleware) newSettings(config *Config, prev *settings, prevConfig *Config) (*settings, error) {
+	s := &settings{headers: config.Headers, health: config.Health}
+	var err error
+	if s.redactor, err = NewRedactor(&config.Redaction); err != nil {
+		return nil, err
+	}
+	if prev != nil && reflect.DeepEqual(config.UserAgent, prevConfig.UserAgent) {
+		s.uaParser = prev.uaParser
+	} else if s.uaParser, err = initUAParser(&config.UserAgent); err != nil {
+		return nil, err
+	}
+	if prev != nil && reflect.DeepEqual(config.Bots, prevConfig.Bots) {
+		s.botClassifier = prev.botClassifier
+	} else if !config.Bots.Disabled {
+		if s.botClassifier, err = NewBotClassifier(&config.Bots, m.Resolver); err != nil {
+			return nil, err
+		}
+	}
+	if s.sampler, err = NewSampler(&config.Sampling); err != nil {
+		return nil, err
+	}
+	s.requestIDHeader = config.Tracing.RequestIDHeader
+	if s.requestIDHeader == "" {
+		s.requestIDHeader = defaultRequestIDHeader
+	}
+	return s, nil
+}
+
+func (m *Middleware) initMaxMind(mm *MaxMind) error {
+	if v, ok := mm.Source["remoteAddr"]; ok && v == "true" {
+		m.IPSource = "remoteAddr"
+	} else if v, ok := mm.Source["header"]; ok {
+		m.IPSource = v
+	} else {
+		return errors.New("Undefined ip source for maxmind")
+	}
+	tmp, err := geoip2.Open(mm.DB)
+	if err != nil {
+		return err
 	}
-	return nickname, sess, http.StatusOK, nil
+	m.MaxMind = tmp
+	return nil
+}
+
+type ClickhouseContext struct {
+	echo.Context
+	*RequestLog
+}
+
+func (m *Middleware) newClickhouseContext(c echo.Context) *ClickhouseContext {
+	l := m.newRequestLog(c.Request(), c.Response().Header())
+	c.SetRequest(c.Request().WithContext(NewContext(c.Request().Context(), l)))
+	return &ClickhouseContext{c, l}
 }
 
 func (c *ClickhouseContext) JSON(code int, msg interface{}) error {
-	defer func(c *ClickhouseContext) {
-		c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-		c.record.ResponseLength = uint64(c.Response().Size)
-		c.record.Status = uint16(c.Response().Status)
-		c.record.Send()
-	}(c)
+	defer c.send()
 	switch msg.(type) {
 	case error:
 		c.record.Error = msg.(error).Error()
@@ -97,199 +215,49 @@ func (c *ClickhouseContext) JSON(code int, msg interface{}) error {
 }
 
 func (c *ClickhouseContext) JSONOK() error {
-	defer func(c *ClickhouseContext) {
-		c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-		c.record.ResponseLength = uint64(c.Response().Size)
-		c.record.Status = uint16(c.Response().Status)
-		c.record.Send()
-	}(c)
+	defer c.send()
 	return c.Context.JSON(http.StatusOK, map[string]string{})
 }
 
 func (c *ClickhouseContext) Render(code int, templ string, vars interface{}) error {
-	defer func(c *ClickhouseContext) {
-		c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-		c.record.ResponseLength = uint64(c.Response().Size)
-		c.record.Status = uint16(c.Response().Status)
-		c.record.Send()
-	}(c)
+	defer c.send()
 	return c.Context.Render(code, templ, vars)
 }
 
 func (c *ClickhouseContext) Redirect(code int, url string) error {
-	defer func(c *ClickhouseContext) {
-		c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-		c.record.ResponseLength = uint64(c.Response().Size)
-		c.record.Status = uint16(c.Response().Status)
-		c.record.Send()
-	}(c)
+	defer c.send()
 	return c.Context.Redirect(code, url)
 }
 
 func (c *ClickhouseContext) String(code int, str string) error {
-	defer func(c *ClickhouseContext) {
-		c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-		c.record.ResponseLength = uint64(c.Response().Size)
-		c.record.Status = uint16(c.Response().Status)
-		c.record.Send()
-	}(c)
+	defer c.send()
 	return c.Context.String(code, str)
 }
 
 func (c *ClickhouseContext) NoContent(code int) error {
 	if aux.Server.LogNoContent {
-		defer func(c *ClickhouseContext) {
-			c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-			c.record.ResponseLength = uint64(c.Response().Size)
-			c.record.Status = uint16(c.Response().Status)
-			c.record.Send()
-		}(c)
+		defer c.send()
 	}
 	return c.Context.NoContent(code)
 }
 
-func (c *ClickhouseContext) SetDBDurationUs(dur time.Duration) {
-	c.record.DBDurationUs = uint64(dur.Microseconds())
-}
-
-func (c *ClickhouseContext) SetSource(source string) {
-	c.record.Source = source
-}
-
-func (c *ClickhouseContext) SetTarget(target string) {
-	c.record.Target = target
-}
-
-func (c *ClickhouseContext) Session() *sessions.Session {
-	return c.sess
-}
-
-func (c *ClickhouseContext) Err() error {
-	return c.redisErr
-}
-
-func (c *ClickhouseContext) Status() int {
-	return c.redisStatus
-}
-
-func (c *ClickhouseContext) Nickname() string {
-	return c.record.User
-}
-
-func (cc *ClickhouseContext) getAccessRecord() {
-	cc.record.Time = time.Now()
-	cc.record.Region = aux.Server.Region
-	cc.record.Location = aux.Server.Location
-	cc.record.Branch = chMiddleware.Branch
-	cc.record.CommitHash = chMiddleware.CommitHash
-	cc.record.Tag = chMiddleware.Tag
-	slug, sess, status, redisErr := cc.userNickname(cc.Context)
-	cc.sess = sess
-	cc.redisStatus = status
-	cc.redisErr = redisErr
-	if sess != nil {
-		cc.record.User = slug
-	}
-	cc.record.RedisDurationUs = uint64(time.Since(cc.record.Time).Microseconds())
-	req := cc.Context.Request()
-	cc.record.Host = req.Host
-	cc.record.Method = req.Method
-	cc.record.RequestURI = req.RequestURI
-	splitted := strings.Split(req.RequestURI[1:len(req.RequestURI)], "/")
-	if len(splitted) > 0 {
-		cc.record.Version = splitted[0]
-	}
-	if len(splitted) > 1 {
-		cc.record.Category = splitted[1]
-	}
-	if len(splitted) > 2 {
-		cc.record.Subject = strings.Split(strings.Join(splitted[2:len(splitted)], "/"), "?")[0]
-	}
-	// cc.record.User is empty when not authorized or anonymous
-	// cc.record.Category should always be
-	// cc.record.Subject may be empty
-	status, err := checkAccess(cc.record.User, cc.record.Category, cc.record.Subject, cc.record.Method)
-	cc.accessStatus = status
-	cc.accessErr = err
-	cc.record.ContentLength = req.ContentLength
-	cc.record.UserAgent = req.Header.Get("User-Agent")
-	cc.record.ClientName = req.Header.Get("X-Client-Name")
-	cc.record.ClientBranch = req.Header.Get("X-Client-Branch")
-	cc.record.ClientCommitHash = req.Header.Get("X-Client-Commit-Hash")
-	cc.record.ClientTag = req.Header.Get("X-Client-Tag")
-	cc.record.OS = req.Header.Get("X-OS")
-	cc.record.Browser = req.Header.Get("X-Browser")
-	params := cc.Context.QueryParams()
-	p, err := json.Marshal(params)
-	if err != nil {
-		log.Warning("Cannot marhal params: ", err)
-	}
-	cc.record.Params = string(p)
-	w := req.Header.Get("X-Width")
-	if w != "" {
-		if width, err := strconv.ParseUint(w, 10, 64); err == nil {
-			cc.record.Width = uint32(width)
-		}
-	}
-	h := req.Header.Get("X-Height")
-	if h != "" {
-		if height, err := strconv.ParseUint(h, 10, 64); err == nil {
-			cc.record.Height = uint32(height)
-		}
-	}
-	ipaddr := ""
-	if chMiddleware.IPSource != "remoteAddr" {
-		if chMiddleware.IPSource != "" {
-			ipaddr = req.Header.Get(chMiddleware.IPSource)
-		}
-	} else {
-		ipaddr = req.RemoteAddr
-	}
-	if ipaddr != "" {
-		ip := net.ParseIP(ipaddr)
-		if chMiddleware.MaxMind != nil {
-			record, err := chMiddleware.MaxMind.City(ip)
-			if err == nil {
-				cc.record.Country = record.Country.Names["en"]
-				cc.record.IsoCountry = record.Country.IsoCode
-				cc.record.City = record.City.Names["en"]
-				cc.record.Longitude = record.Location.Longitude
-				cc.record.Latitude = record.Location.Latitude
-				cc.record.Timezone = record.Location.TimeZone
-				cc.record.Continent = record.Continent.Names["en"]
-				cc.record.AccuracyRadius = record.Location.AccuracyRadius
-				cc.record.IsInEuropeanUnion = record.Country.IsInEuropeanUnion
-				loc, _ := time.LoadLocation(cc.record.Timezone)
-				cc.record.ClientTime = cc.record.Time.In(loc)
-				subd := record.Subdivisions
-				if len(subd) > 0 {
-					cc.record.Subdivision = subd[0].Names["en"]
-				}
-			} else {
-				log.Warning("Cannot determine ip location: ", err)
-			}
-		}
-		cc.record.RemoteAddr = ipaddr
-	}
+func (c *ClickhouseContext) send() {
+	c.finish(c.Response().Status, c.Response().Size, c.Response().Header())
 }
 
-func ClickhouseMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+func (m *Middleware) ClickhouseMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		cc := &ClickhouseContext{c, logger.AccessRecord{}, nil, http.StatusOK, nil, http.StatusOK, nil}
-		cc.getAccessRecord()
+		cc := m.newClickhouseContext(c)
 		if err := next(cc); err != nil {
 			cc.record.Error = err.Error()
-			cc.record.DurationUs = uint64(time.Since(cc.record.Time).Microseconds())
-			cc.record.ResponseLength = uint64(cc.Response().Size)
-			cc.record.Status = uint16(cc.Response().Status)
-			cc.record.Send()
+			cc.send()
 			return err
 		}
 		return nil
 	}
 }
 
-func ClickhouseHTTPErrorHandler(err error, c echo.Context) {
+func (m *Middleware) ClickhouseHTTPErrorHandler(err error, c echo.Context) {
 	he, ok := err.(*echo.HTTPError)
 	if ok {
 		if he.Internal != nil {
@@ -312,15 +280,9 @@ func ClickhouseHTTPErrorHandler(err error, c echo.Context) {
 			err1 = c.NoContent(he.Code)
 		} else {
 			msg := he.Message.(string)
-			cc := &ClickhouseContext{c, logger.AccessRecord{}, nil, http.StatusOK, nil, http.StatusOK, nil}
-			cc.getAccessRecord()
+			cc := m.newClickhouseContext(c)
 			cc.record.Error = msg
-			defer func(c *ClickhouseContext) {
-				c.record.DurationUs = uint64(time.Since(c.record.Time).Microseconds())
-				c.record.ResponseLength = uint64(c.Response().Size)
-				c.record.Status = uint16(c.Response().Status)
-				c.record.Send()
-			}(cc)
+			defer cc.send()
 			err1 = c.JSON(code, map[string]interface{}{"error": msg})
 		}
 		if err1 != nil {
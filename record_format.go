@@ -0,0 +1,266 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatLogfmt   = "logfmt"
+	FormatCombined = "combined"
+
+	// keys of JSON records: ClickHouse column names or JSON names of
+	// AccessRecord
+	NamingSnake = "snake"
+	NamingCamel = "camel"
+)
+
+// recordFormatter appends one line with the record to buf
+type recordFormatter func(buf *bytes.Buffer, ar *AccessRecord) error
+
+func newRecordFormatter(format string) (recordFormatter, error) {
+	switch format {
+	case FormatJSON, "":
+		return formatJSON, nil
+	case FormatLogfmt:
+		return formatLogfmt, nil
+	case FormatCombined:
+		return formatCombined, nil
+	}
+	return nil, errors.New("Unknown record format: " + format)
+}
+
+func formatJSON(buf *bytes.Buffer, ar *AccessRecord) error {
+	b, err := json.Marshal(ar)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	buf.WriteByte('\n')
+	return nil
+}
+
+type recordField struct {
+	index int
+	key   string
+}
+
+// recordFields lists fields of AccessRecord in declaration order, keys are
+// ClickHouse column names in snake naming
+func recordFields(naming string) []recordField {
+	t := reflect.TypeOf(AccessRecord{})
+	fields := []recordField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name[:1]) + f.Name[1:]
+		}
+		if name == "-" {
+			continue
+		}
+		key := name
+		if naming == NamingSnake {
+			key = f.Tag.Get("db")
+			if key == "" || key == "-" {
+				continue
+			}
+		}
+		fields = append(fields, recordField{i, key})
+	}
+	return fields
+}
+
+// newJSONFormatter writes selected fields, all when names is empty, in
+// declaration order. Unknown names are an error.
+func newJSONFormatter(naming string, names []string, omitEmpty bool) (recordFormatter, error) {
+	if naming != NamingSnake && naming != NamingCamel {
+		return nil, errors.New("Unknown naming: " + naming)
+	}
+	all := recordFields(naming)
+	fields := all
+	if len(names) > 0 {
+		fields = []recordField{}
+		for _, f := range all {
+			if StringInSlice(f.key, names) {
+				fields = append(fields, f)
+			}
+		}
+		if len(fields) != len(names) {
+			for _, name := range names {
+				found := false
+				for _, f := range all {
+					found = found || f.key == name
+				}
+				if !found {
+					return nil, errors.New("Unknown field: " + name)
+				}
+			}
+		}
+	}
+	return func(buf *bytes.Buffer, ar *AccessRecord) error {
+		v := reflect.ValueOf(ar).Elem()
+		buf.WriteByte('{')
+		first := true
+		for _, f := range fields {
+			field := v.Field(f.index)
+			if omitEmpty && field.IsZero() {
+				continue
+			}
+			b, err := json.Marshal(field.Interface())
+			if err != nil {
+				return err
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			buf.WriteString(strconv.Quote(f.key))
+			buf.WriteByte(':')
+			buf.Write(b)
+		}
+		buf.WriteString("}\n")
+		return nil
+	}, nil
+}
+
+// formatLogfmt writes non-empty columns as key=value with ClickHouse column
+// names as keys. Captured headers go as request_headers.<name>.
+func formatLogfmt(buf *bytes.Buffer, ar *AccessRecord) error {
+	v := reflect.ValueOf(ar).Elem()
+	t := v.Type()
+	first := true
+	pair := func(key, value string) {
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(value))
+	}
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("db")
+		field := v.Field(i)
+		if key == "" || key == "-" || field.Kind() == reflect.Map || field.IsZero() {
+			continue
+		}
+		if tm, ok := field.Interface().(time.Time); ok {
+			pair(key, tm.Format(time.RFC3339Nano))
+			continue
+		}
+		pair(key, formatValue(field))
+	}
+	for _, h := range []struct {
+		prefix string
+		values map[string]string
+	}{{"request_headers.", ar.RequestHeaders}, {"response_headers.", ar.ResponseHeaders}} {
+		names := make([]string, 0, len(h.values))
+		for name := range h.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pair(h.prefix+name, h.values[name])
+		}
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+	b, _ := json.Marshal(v.Interface())
+	return string(b)
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatCombined writes the combined log format of Apache and nginx. The
+// protocol is not recorded, so the request line has only method and URI.
+// Referer is known when the header is captured.
+func formatCombined(buf *bytes.Buffer, ar *AccessRecord) error {
+	size := "-"
+	if ar.ResponseLength > 0 {
+		size = strconv.FormatUint(ar.ResponseLength, 10)
+	}
+	buf.WriteString(combinedField(ar.RemoteAddr))
+	buf.WriteString(" - ")
+	buf.WriteString(combinedField(ar.User))
+	buf.WriteString(" [")
+	buf.WriteString(ar.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString("] ")
+	buf.WriteString(combinedQuote(ar.Method + " " + ar.RequestURI))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(int(ar.Status)))
+	buf.WriteByte(' ')
+	buf.WriteString(size)
+	buf.WriteByte(' ')
+	buf.WriteString(combinedQuote(headerValue(ar.RequestHeaders, "Referer")))
+	buf.WriteByte(' ')
+	buf.WriteString(combinedQuote(ar.UserAgent))
+	buf.WriteByte('\n')
+	return nil
+}
+
+func combinedField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "%20", -1)
+}
+
+// combinedQuote escapes like nginx does: quotes, backslashes and control
+// characters as \xHH
+func combinedQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c < ' ' || c == 0x7f {
+			b.WriteString(`\x`)
+			b.WriteString(strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
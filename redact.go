@@ -0,0 +1,318 @@
+package ECMSLogger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const defaultReplacement = "[REDACTED]"
+
+var builtinPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	"card":  `\b(?:\d[ \-]?){12,18}\d\b`,
+	// international numbers start with +, national ones need spaces, dashes
+	// or parentheses between groups. Dots are not separators, so addresses
+	// and versions are left alone.
+	"phone": `\+\d{1,3}[ \-]?(?:\(\d{1,4}\)[ \-]?)?\d{1,4}(?:[ \-]?\d{1,4}){1,5}|(?:\(\d{2,4}\)[ \-]?|\d{1,4}[ \-])\d{2,4}(?:[ \-]\d{2,4}){1,3}`,
+}
+
+type Redactor struct {
+	replacement string
+	keys        map[string]bool
+	paths       [][]string
+	regexes     []*regexp.Regexp
+	cardRegex   *regexp.Regexp
+	phoneRegex  *regexp.Regexp
+}
+
+// NewRedactor compiles redaction settings. Keys are matched case-insensitively
+// against query params, headers and JSON object keys at any depth. Paths are
+// dot-separated JSON paths from the body root where `*` matches any key or
+// array element.
+func NewRedactor(r *Redaction) (*Redactor, error) {
+	rd := &Redactor{
+		replacement: r.Replacement,
+		keys:        make(map[string]bool, len(r.Keys)),
+	}
+	if rd.replacement == "" {
+		rd.replacement = defaultReplacement
+	}
+	for _, k := range r.Keys {
+		rd.keys[strings.ToLower(k)] = true
+	}
+	for _, p := range r.Paths {
+		if p == "" {
+			return nil, errors.New("Empty redaction path")
+		}
+		rd.paths = append(rd.paths, strings.Split(p, "."))
+	}
+	for _, name := range r.Patterns {
+		expr, ok := builtinPatterns[name]
+		if !ok {
+			return nil, errors.New("Unknown redaction pattern: " + name)
+		}
+		re := regexp.MustCompile(expr)
+		if name == "card" {
+			// card numbers are checked with Luhn to avoid eating every long number
+			rd.cardRegex = re
+			continue
+		}
+		if name == "phone" {
+			rd.phoneRegex = re
+			continue
+		}
+		rd.regexes = append(rd.regexes, re)
+	}
+	for _, expr := range r.Regexes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.New("Wrong redaction regex " + expr + ": " + err.Error())
+		}
+		rd.regexes = append(rd.regexes, re)
+	}
+	return rd, nil
+}
+
+func (r *Redactor) initialized() bool {
+	return r != nil && (len(r.keys) > 0 || len(r.paths) > 0 || len(r.regexes) > 0 || r.cardRegex != nil || r.phoneRegex != nil)
+}
+
+func (r *Redactor) Replacement() string {
+	if r == nil {
+		return defaultReplacement
+	}
+	return r.replacement
+}
+
+func (r *Redactor) IsSensitiveKey(key string) bool {
+	if r == nil {
+		return false
+	}
+	return r.keys[strings.ToLower(key)]
+}
+
+// String applies value patterns to free text
+func (r *Redactor) String(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	if r.cardRegex != nil {
+		s = r.cardRegex.ReplaceAllStringFunc(s, func(m string) string {
+			if luhnValid(m) {
+				return r.replacement
+			}
+			return m
+		})
+	}
+	if r.phoneRegex != nil {
+		s = r.replacePhones(s)
+	}
+	for _, re := range r.regexes {
+		s = re.ReplaceAllString(s, r.replacement)
+	}
+	return s
+}
+
+// replacePhones replaces phone matches which are not a part of a longer
+// number, a dotted address or a word and have as many digits as phones do
+func (r *Redactor) replacePhones(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range r.phoneRegex.FindAllStringIndex(s, -1) {
+		if !phoneLike(s, loc[0], loc[1]) {
+			continue
+		}
+		b.WriteString(s[last:loc[0]])
+		b.WriteString(r.replacement)
+		last = loc[1]
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func phoneLike(s string, start, end int) bool {
+	if start > 0 {
+		if c := s[start-1]; c == '.' || c == '+' || c == '_' || isAlnum(c) {
+			return false
+		}
+	}
+	if end < len(s) {
+		c := s[end]
+		if c == '_' || isAlnum(c) || (c == '.' || c == '-') && end+1 < len(s) && isDigit(s[end+1]) {
+			return false
+		}
+	}
+	digits := 0
+	for i := start; i < end; i++ {
+		if isDigit(s[i]) {
+			digits++
+		}
+	}
+	// E.164 has at most 15 digits. Without country code 9 digits at least,
+	// so dates like 2024-03-01 are not phones.
+	min := 9
+	if s[start] == '+' {
+		min = 7
+	}
+	return digits >= min && digits <= 15
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Header returns a copy of h with sensitive headers masked
+func (r *Redactor) Header(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, vals := range h {
+		res[k] = r.HeaderValues(k, vals)
+	}
+	return res
+}
+
+func (r *Redactor) HeaderValues(name string, vals []string) []string {
+	res := make([]string, len(vals))
+	for i, v := range vals {
+		if r.IsSensitiveKey(name) {
+			res[i] = r.Replacement()
+		} else {
+			res[i] = r.String(v)
+		}
+	}
+	return res
+}
+
+// JSON redacts a serialized document. Bodies that are not valid JSON are
+// handled as free text.
+func (r *Redactor) JSON(body string) string {
+	if body == "" {
+		return body
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return r.String(body)
+	}
+	doc = r.walk(doc, []string{})
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return r.replacement
+	}
+	return string(b)
+}
+
+func (r *Redactor) walk(v interface{}, path []string) interface{} {
+	if r.matchPath(path) {
+		return r.replacement
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			if r.IsSensitiveKey(k) {
+				t[k] = r.replacement
+				continue
+			}
+			t[k] = r.walk(child, append(path, k))
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = r.walk(child, append(path, "*"))
+		}
+		return t
+	case string:
+		return r.String(t)
+	default:
+		return v
+	}
+}
+
+func (r *Redactor) matchPath(path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	for _, p := range r.paths {
+		if len(p) != len(path) {
+			continue
+		}
+		matched := true
+		for i := range p {
+			if p[i] != "*" && path[i] != "*" && p[i] != path[i] {
+				matched = false
+				break
+			}
+			if path[i] == "*" && p[i] != "*" {
+				// array elements can be addressed only with wildcard
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Record redacts every free-form field of the record in place
+func (r *Redactor) Record(ar *AccessRecord) {
+	if !r.initialized() {
+		return
+	}
+	ar.Params = r.JSON(ar.Params)
+	ar.Response = r.JSON(ar.Response)
+	ar.Error = r.String(ar.Error)
+	ar.RequestURI = r.uri(ar.RequestURI)
+	ar.Subject = r.String(ar.Subject)
+	ar.DBSlowestQuery = r.String(ar.DBSlowestQuery)
+}
+
+func (r *Redactor) uri(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return r.String(uri)
+	}
+	pairs := strings.Split(uri[i+1:], "&")
+	for j, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && r.IsSensitiveKey(kv[0]) {
+			pairs[j] = kv[0] + "=" + r.replacement
+		} else {
+			pairs[j] = r.String(pair)
+		}
+	}
+	return r.String(uri[:i]) + "?" + strings.Join(pairs, "&")
+}
+
+func luhnValid(s string) bool {
+	sum := 0
+	n := 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		if c < '0' || c > '9' {
+			return false
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
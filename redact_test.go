@@ -0,0 +1,44 @@
+package ECMSLogger
+
+import (
+	"testing"
+)
+
+func TestRedactPhone(t *testing.T) {
+	r, err := NewRedactor(&Redaction{Patterns: []string{"phone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := []string{
+		"+1 555 123 4567",
+		"+7 (495) 123-45-67",
+		"+442071234567",
+		"+49-30-1234567",
+		"555-123-4567",
+		"(495) 123-45-67",
+		"8 495 123 45 67",
+	}
+	for _, phone := range redacted {
+		in := "call " + phone + ", please"
+		if got := r.String(in); got != "call [REDACTED], please" {
+			t.Errorf("%q gives %q", in, got)
+		}
+	}
+	kept := []string{
+		"from 10.0.0.1",
+		"from 192.168.100.200:8080",
+		"range 10.20.30.40-10.20.30.50",
+		"id 123456789012345",
+		"order 98765432",
+		"user_4951234567",
+		"on 2024-03-01 at 10:20:30",
+		"version 1.22.333",
+		"trace 4bf92f3577b34da6",
+		"+1234567890123456789",
+	}
+	for _, s := range kept {
+		if got := r.String(s); got != s {
+			t.Errorf("%q gives %q", s, got)
+		}
+	}
+}
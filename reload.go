@@ -0,0 +1,154 @@
+package ECMSLogger
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultWatchInterval = 5 * time.Second
+
+// Reload applies settings which can change while running: redaction,
+// headers, userAgent, bots, sampling, tracing, health thresholds, batch size
+// and flush period. Other changed settings are not applied, their YAML paths
+// are returned as requiring a restart. A batch size which does not fit into
+// the queue of the running logger is an error.
+func (m *Middleware) Reload(config *Config) ([]string, error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	old := m.config
+	if m.Logger != nil && config.Clickhouse.BatchSize >= old.Clickhouse.MaxQueueSize {
+		return nil, ValidationErrors{{
+			Path:    "clickhouse.batchSize",
+			Message: fmt.Sprintf("must be less than maxQueueSize of the running logger (%d), restart to raise both", old.Clickhouse.MaxQueueSize),
+		}}
+	}
+	prev := m.settings()
+	s, err := m.newSettings(config, prev, old)
+	if err != nil {
+		return nil, err
+	}
+	restart := restartRequired(old, config)
+
+	applied := *config
+	applied.MaxMind = old.MaxMind
+	applied.Metrics = old.Metrics
+	applied.Health.Enabled = old.Health.Enabled
+	applied.Health.Path = old.Health.Path
+	applied.Clickhouse = old.Clickhouse
+	applied.Clickhouse.BatchSize = config.Clickhouse.BatchSize
+	applied.Clickhouse.Period = config.Clickhouse.Period
+	applied.Sinks = old.Sinks
+
+	m.mu.Lock()
+	m.live = s
+	m.config = &applied
+	m.mu.Unlock()
+	if s.botClassifier != prev.botClassifier {
+		prev.botClassifier.closeLater()
+	}
+	if m.Logger != nil && (applied.Clickhouse.BatchSize != old.Clickhouse.BatchSize || applied.Clickhouse.Period != old.Clickhouse.Period) {
+		m.Logger.SetBatching(applied.Clickhouse.BatchSize, applied.Clickhouse.Period)
+	}
+	return restart, nil
+}
+
+func restartRequired(old, config *Config) []string {
+	res := []string{}
+	check := func(path string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			res = append(res, path)
+		}
+	}
+	check("maxmind", old.MaxMind, config.MaxMind)
+	check("clickhouse.disabled", old.Clickhouse.Disabled, config.Clickhouse.Disabled)
+	check("clickhouse.table", old.Clickhouse.Table, config.Clickhouse.Table)
+	check("clickhouse.maxQueueSize", old.Clickhouse.MaxQueueSize, config.Clickhouse.MaxQueueSize)
+	check("clickhouse.connection", old.Clickhouse.Connection, config.Clickhouse.Connection)
+	check("clickhouse.reserve", old.Clickhouse.Reserve, config.Clickhouse.Reserve)
+	check("clickhouse.migrate", old.Clickhouse.Migrate, config.Clickhouse.Migrate)
+	check("sinks", old.Sinks, config.Sinks)
+	check("metrics", old.Metrics, config.Metrics)
+	check("health.enabled", old.Health.Enabled, config.Health.Enabled)
+	check("health.path", old.Health.Path, config.Health.Path)
+	return res
+}
+
+// ReloadFile reads and validates filename with ReadConfig and applies it
+// with Reload
+func (m *Middleware) ReloadFile(filename string) ([]string, error) {
+	config, err := ReadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	return m.Reload(&config)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(filename string) fileStamp {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+// WatchConfig reloads filename on SIGHUP and when its modification time or
+// size changes, checked every interval. Stat follows symlinks, so swaps of
+// mounted Kubernetes ConfigMaps are noticed too. Results are logged. The
+// returned function stops watching.
+func (m *Middleware) WatchConfig(filename string, interval time.Duration) func() {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	stop := make(chan struct{})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := statFile(filename)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-hup:
+				last = statFile(filename)
+				m.reloadAndLog(filename)
+			case <-ticker.C:
+				if st := statFile(filename); st != last {
+					last = st
+					m.reloadAndLog(filename)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+func (m *Middleware) reloadAndLog(filename string) {
+	restart, err := m.ReloadFile(filename)
+	if err != nil {
+		log.Error("Config ", filename, " is not reloaded: ", err)
+		return
+	}
+	if len(restart) > 0 {
+		log.Warning("Config ", filename, " is reloaded, restart to apply: ", strings.Join(restart, ", "))
+		return
+	}
+	log.Info("Config ", filename, " is reloaded")
+}
@@ -0,0 +1,133 @@
+package ECMSLogger
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReloadMiddleware returns a middleware started with a valid config and
+// a logger which never reaches ClickHouse
+func testReloadMiddleware(t *testing.T) *Middleware {
+	m, _ := testMiddleware(t)
+	config := testReloadConfig()
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := m.newSettings(config, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.live, m.config = s, config
+	if m.Logger, err = NewLogger(&config.Clickhouse); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func testReloadConfig() *Config {
+	c := &Config{}
+	c.MaxMind.DB = "GeoLite2-City.mmdb"
+	c.MaxMind.Source = map[string]string{"remoteAddr": "true"}
+	c.Clickhouse.Table = "access"
+	c.Clickhouse.Connection.Port = "1"
+	c.Headers.Request = []string{"Accept"}
+	c.Bots.Disabled = true
+	return c
+}
+
+func TestReload(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		change  func(c *Config)
+		restart []string
+		err     string
+	}{
+		{
+			name: "live settings",
+			change: func(c *Config) {
+				c.Headers.Request = []string{"Accept", "Referer"}
+				c.Tracing.RequestIDHeader = "X-Trace"
+			},
+		},
+		{
+			name:   "batching",
+			change: func(c *Config) { c.Clickhouse.BatchSize = 500; c.Clickhouse.Period = time.Second },
+		},
+		{
+			name: "restart",
+			change: func(c *Config) {
+				c.MaxMind.DB = "other.mmdb"
+				c.Clickhouse.Table = "access2"
+				c.Clickhouse.MaxQueueSize = 5000
+			},
+			restart: []string{"maxmind", "clickhouse.table", "clickhouse.maxQueueSize"},
+		},
+		{
+			name: "batch size above running queue",
+			change: func(c *Config) {
+				c.Clickhouse.BatchSize = 2000
+				c.Clickhouse.MaxQueueSize = 5000
+			},
+			err: "clickhouse.batchSize",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testReloadMiddleware(t)
+			defer m.Logger.Close()
+			before := m.settings()
+			config := testReloadConfig()
+			tt.change(config)
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			restart, err := m.Reload(config)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v", err)
+				}
+				if m.settings() != before {
+					t.Error("settings are replaced by a rejected config")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(restart, ",") != strings.Join(tt.restart, ",") {
+				t.Errorf("restart %v, want %v", restart, tt.restart)
+			}
+			s := m.settings()
+			if !reflect.DeepEqual(s.headers, config.Headers) || s.requestIDHeader != config.Tracing.RequestIDHeader {
+				t.Errorf("settings %+v", s)
+			}
+			// settings which need a restart keep their running values
+			if m.config.MaxMind.DB != "GeoLite2-City.mmdb" || m.config.Clickhouse.Table != "access" || m.config.Clickhouse.MaxQueueSize != DefaultMaxQueueSize {
+				t.Errorf("applied %+v", m.config)
+			}
+			if m.config.Clickhouse.BatchSize != config.Clickhouse.BatchSize || m.config.Clickhouse.Period != config.Clickhouse.Period {
+				t.Errorf("batching %d %s", m.config.Clickhouse.BatchSize, m.config.Clickhouse.Period)
+			}
+		})
+	}
+}
+
+func TestSetBatchingDoesNotWait(t *testing.T) {
+	// nothing reads batching, as if the writer was stuck in a flush
+	l := &Logger{batching: make(chan batching, 1)}
+	done := make(chan struct{})
+	go func() {
+		l.SetBatching(200, time.Second)
+		l.SetBatching(300, 2*time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetBatching waits for the writer")
+	}
+	if b := <-l.batching; b.size != 300 || b.period != 2*time.Second {
+		t.Errorf("writer gets %+v", b)
+	}
+}
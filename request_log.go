@@ -0,0 +1,301 @@
+package ECMSLogger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestLog holds the record of a request in flight. It does not depend on
+// echo, so every adapter (echo middleware, net/http handler) builds the same
+// AccessRecord.
+type RequestLog struct {
+	record       AccessRecord
+	sess         *sessions.Session
+	redisStatus  int
+	redisErr     error
+	accessStatus int
+	accessErr    error
+	uaInfo       UAInfo
+	m            *Middleware
+	s            *settings
+	// guards timing accumulators which may be updated from goroutines
+	mu sync.Mutex
+}
+
+type requestLogKey struct{}
+
+func NewContext(ctx context.Context, l *RequestLog) context.Context {
+	return context.WithValue(ctx, requestLogKey{}, l)
+}
+
+// FromContext returns the RequestLog of the request or nil when the request
+// did not pass through the logging middleware
+func FromContext(ctx context.Context) *RequestLog {
+	l, _ := ctx.Value(requestLogKey{}).(*RequestLog)
+	return l
+}
+
+func (m *Middleware) userNickname(req *http.Request) (string, *sessions.Session, int, error) {
+	sess, err := aux.Store.Get(req, aux.Session.Cookie)
+	if err != nil {
+		return "", nil, http.StatusInternalServerError, err
+	}
+	interfaceId, ok := sess.Values[m.SessionField]
+	if !ok {
+		return "", nil, http.StatusBadRequest, errors.New(m.SessionField + " is not found")
+	}
+	nickname := interfaceId.(string)
+	if nickname == "" {
+		return "", nil, http.StatusTemporaryRedirect, errors.New(m.SessionField + " is empty")
+	}
+	if twofaId, ok := sess.Values["2fa"]; ok {
+		twofa := twofaId.(bool)
+		if !twofa {
+			return nickname, sess, http.StatusForbidden, errors.New("2FA has not finished")
+		}
+	}
+	return nickname, sess, http.StatusOK, nil
+}
+
+// newRequestLog fills everything known before the handler runs. Request id
+// is echoed into resp.
+func (m *Middleware) newRequestLog(req *http.Request, resp http.Header) *RequestLog {
+	l := m.startRequestLog()
+	l.fillSession(req)
+	l.record.fillTrace(req.Header, resp, l.s.requestIDHeader)
+	resp.Set(l.s.requestIDHeader, l.record.RequestID)
+	l.record.Host = req.Host
+	l.record.Method = req.Method
+	// RequestURI is empty in requests made by clients or tests
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	l.record.RequestURI = uri
+	version, category, subject := "", "", ""
+	splitted := strings.Split(strings.TrimPrefix(uri, "/"), "/")
+	if len(splitted) > 0 {
+		version = splitted[0]
+	}
+	if len(splitted) > 1 {
+		category = splitted[1]
+	}
+	if len(splitted) > 2 {
+		subject = strings.Split(strings.Join(splitted[2:len(splitted)], "/"), "?")[0]
+	}
+	l.fillRoute(version, category, subject)
+	l.record.ContentLength = req.ContentLength
+	l.fillHeaders(req.Header)
+	params := req.URL.Query()
+	p, err := json.Marshal(params)
+	if err != nil {
+		log.Warning("Cannot marhal params: ", err)
+	}
+	l.record.Params = string(p)
+	l.fillClient(m.clientAddr(req.Header, req.RemoteAddr))
+	return l
+}
+
+func (m *Middleware) startRequestLog() *RequestLog {
+	l := &RequestLog{redisStatus: http.StatusOK, accessStatus: http.StatusOK, m: m, s: m.settings()}
+	l.record.Time = time.Now()
+	l.record.Kind = inboundKind
+	l.record.Region = aux.Server.Region
+	l.record.Location = aux.Server.Location
+	l.record.Branch = m.Branch
+	l.record.CommitHash = m.CommitHash
+	l.record.Tag = m.Tag
+	return l
+}
+
+func (l *RequestLog) fillSession(req *http.Request) {
+	slug, sess, status, redisErr := l.m.userNickname(req)
+	l.sess = sess
+	l.redisStatus = status
+	l.redisErr = redisErr
+	if sess != nil {
+		l.record.User = slug
+	}
+	l.record.RedisDurationUs = uint64(time.Since(l.record.Time).Microseconds())
+}
+
+func (l *RequestLog) fillRoute(version, category, subject string) {
+	l.record.Version = version
+	l.record.Category = category
+	l.record.Subject = subject
+	// l.record.User is empty when not authorized or anonymous
+	// l.record.Category should always be
+	// l.record.Subject may be empty
+	status, err := checkAccess(l.record.User, l.record.Category, l.record.Subject, l.record.Method)
+	l.accessStatus = status
+	l.accessErr = err
+}
+
+func (l *RequestLog) fillHeaders(h http.Header) {
+	l.record.UserAgent = h.Get("User-Agent")
+	l.record.ClientName = h.Get("X-Client-Name")
+	l.record.ClientBranch = h.Get("X-Client-Branch")
+	l.record.ClientCommitHash = h.Get("X-Client-Commit-Hash")
+	l.record.ClientTag = h.Get("X-Client-Tag")
+	l.record.OS = h.Get("X-OS")
+	l.record.Browser = h.Get("X-Browser")
+	if l.s.uaParser != nil {
+		l.uaInfo = l.s.uaParser.Parse(l.record.UserAgent)
+		l.record.fillUserAgent(l.uaInfo)
+	}
+	l.record.RequestHeaders = l.s.captureHeaders(h, l.s.headers.Request)
+	w := h.Get("X-Width")
+	if w != "" {
+		if width, err := strconv.ParseUint(w, 10, 64); err == nil {
+			l.record.Width = uint32(width)
+		}
+	}
+	ht := h.Get("X-Height")
+	if ht != "" {
+		if height, err := strconv.ParseUint(ht, 10, 64); err == nil {
+			l.record.Height = uint32(height)
+		}
+	}
+}
+
+func (m *Middleware) clientAddr(h http.Header, remoteAddr string) string {
+	if m.IPSource != "remoteAddr" {
+		if m.IPSource != "" {
+			return h.Get(m.IPSource)
+		}
+		return ""
+	}
+	return remoteAddr
+}
+
+// fillClient adds geo location and bot classification
+func (l *RequestLog) fillClient(ipaddr string) {
+	if ipaddr != "" {
+		if l.m.MaxMind != nil {
+			if err := l.record.FillGeo(l.m.MaxMind, ipaddr); err != nil {
+				log.Warning("Cannot determine ip location: ", err)
+			}
+		}
+		l.record.RemoteAddr = ipaddr
+	}
+	if l.s.botClassifier != nil {
+		l.record.fillBot(l.s.botClassifier.Classify(l.record.UserAgent, parseIP(ipaddr), l.uaInfo))
+	}
+}
+
+// FillGeo sets location fields of the record by ip and client time by its
+// timezone
+func (ar *AccessRecord) FillGeo(db *geoip2.Reader, ipaddr string) error {
+	ip := net.ParseIP(ipaddr)
+	if ip == nil {
+		return errors.New("Wrong ip address: " + ipaddr)
+	}
+	record, err := db.City(ip)
+	if err != nil {
+		return err
+	}
+	ar.Country = record.Country.Names["en"]
+	ar.IsoCountry = record.Country.IsoCode
+	ar.City = record.City.Names["en"]
+	ar.Longitude = record.Location.Longitude
+	ar.Latitude = record.Location.Latitude
+	ar.Timezone = record.Location.TimeZone
+	ar.Continent = record.Continent.Names["en"]
+	ar.AccuracyRadius = record.Location.AccuracyRadius
+	ar.IsInEuropeanUnion = record.Country.IsInEuropeanUnion
+	loc, _ := time.LoadLocation(ar.Timezone)
+	ar.ClientTime = ar.Time.In(loc)
+	subd := record.Subdivisions
+	if len(subd) > 0 {
+		ar.Subdivision = subd[0].Names["en"]
+	}
+	return nil
+}
+
+// finish completes the record with response data and queues it
+func (l *RequestLog) finish(status int, size int64, resp http.Header) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.DurationUs = uint64(time.Since(l.record.Time).Microseconds())
+	l.record.ResponseLength = uint64(size)
+	l.record.Status = uint16(status)
+	metrics := l.m.stats
+	metrics.observeRequest(&l.record)
+	if l.record.IsBot && l.s.botClassifier != nil && l.s.botClassifier.Skip {
+		metrics.observeDropped("bot", 1)
+		return
+	}
+	if !l.s.sampler.Keep(&l.record) {
+		metrics.observeDropped("sampled", 1)
+		return
+	}
+	l.record.ResponseHeaders = l.s.captureHeaders(resp, l.s.headers.Response)
+	l.s.redactor.Record(&l.record)
+	l.m.send(l.record)
+}
+
+// SetDBDurationUs overwrites accumulated database time, prefer AddDBDuration
+// or RegisterTimedDriver
+func (l *RequestLog) SetDBDurationUs(dur time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.DBDurationUs = uint64(dur.Microseconds())
+}
+
+func (l *RequestLog) SetSource(source string) {
+	l.record.Source = source
+}
+
+func (l *RequestLog) SetTarget(target string) {
+	l.record.Target = target
+}
+
+// SetError is for handlers which cannot return an error, e.g. net/http ones
+func (l *RequestLog) SetError(err error) {
+	if err != nil {
+		l.record.Error = err.Error()
+	}
+}
+
+func (l *RequestLog) Session() *sessions.Session {
+	return l.sess
+}
+
+func (l *RequestLog) Err() error {
+	return l.redisErr
+}
+
+func (l *RequestLog) Status() int {
+	return l.redisStatus
+}
+
+func (l *RequestLog) Nickname() string {
+	return l.record.User
+}
+
+func (l *RequestLog) RequestID() string {
+	return l.record.RequestID
+}
+
+func (l *RequestLog) TraceID() string {
+	return l.record.TraceID
+}
+
+func (l *RequestLog) SpanID() string {
+	return l.record.SpanID
+}
+
+// Traceparent should be sent with outgoing requests made by the handler
+func (l *RequestLog) Traceparent() string {
+	return l.record.Traceparent()
+}
@@ -1,90 +1,154 @@
 package ECMSLogger
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"errors"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
-	"os"
-	"path"
-	"path/filepath"
-	"strconv"
-	"strings"
-	"time"
+	"sync"
 )
 
-var maxSize int64
+// ReserveFiles returns reserve files of dir, the oldest first
+func ReserveFiles(dir string) ([]string, error) {
+	files, err := listRotated(dir, "", ".log", true)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, len(files))
+	for i, f := range files {
+		res[i] = f.path
+	}
+	return res, nil
+}
 
-func rotateLogDir(reserve *Reserve) error {
-	if reserve == nil {
-		return nil
-	}
-	var files []string
-	err := filepath.Walk(reserve.Dir, func(path string, info os.FileInfo, err error) error {
-		if filepath.Ext(path) == ".log" {
-			files = append(files, info.Name())
+// reserveWriter keeps batches which could not be delivered in the reserve
+// dir until they are replayed
+type reserveWriter struct {
+	conf *Reserve
+	// limits of a file and of all files
+	maxSize      int64
+	maxTotalSize int64
+	keys         ReserveKeys
+	encoding     reserveEncoding
+	// serializes writes, so overlapping flushes never share a sequence number
+	mu       sync.Mutex
+	rotation *rotation
+	// set by the owner before the first write
+	metrics *Metrics
+	log     *log.Entry
+}
+
+func newReserveWriter(r *Reserve, entry *log.Entry) (*reserveWriter, error) {
+	w := &reserveWriter{conf: r, log: entry}
+	w.maxSize = ParseSize(r.Rotate.MaxSize)
+	if w.maxSize <= 0 {
+		return nil, errors.New("Wrong reserve maxSize: " + r.Rotate.MaxSize)
+	}
+	w.maxTotalSize = int64(r.Rotate.MaxFiles) * w.maxSize
+	if r.MaxTotalSize != "" {
+		w.maxTotalSize = ParseSize(r.MaxTotalSize)
+		if w.maxTotalSize <= 0 {
+			return nil, errors.New("Wrong reserve maxTotalSize: " + r.MaxTotalSize)
 		}
-		return nil
-	})
+	}
+	keys, err := NewReserveKeys(r.Encryption)
 	if err != nil {
-		return err
+		return nil, errors.New("Wrong reserve encryption: " + err.Error())
 	}
-	for _, f := range files {
-		oldpath := path.Join(reserve.Dir, f)
-		a := strings.Split(f, "_")
-		tmp, _ := strconv.Atoi(a[0])
-		tmp += 1
-		if tmp > reserve.Rotate.MaxFiles {
-			err := os.Remove(oldpath)
-			if err != nil {
-				return err
-			}
-			continue
-		}
-		a[0] = strconv.Itoa(tmp)
-		fn := strings.Join(a, "_")
-		newpath := path.Join(reserve.Dir, fn)
-		err := os.Rename(oldpath, newpath)
-		if err != nil {
-			return err
-		}
+	w.keys = keys
+	w.encoding = newReserveEncoding(r, keys)
+	if err := CheckTouch(r.Dir); err != nil {
+		return nil, errors.New("Cannot touch in " + r.Dir + ": " + err.Error())
+	}
+	w.rotation = &rotation{
+		dir:            r.Dir,
+		ext:            ".log",
+		legacy:         true,
+		maxFiles:       r.Rotate.MaxFiles,
+		maxTotalSize:   w.maxTotalSize,
+		minFreePercent: r.MinFreePercent,
+		stop:           r.OnFull == ReserveStop,
+		log:            entry,
+		onEvict:        w.evicted,
 	}
-	return nil
+	if err := w.rotation.init(); err != nil {
+		return nil, err
+	}
+	if err := claimDir(r.Dir, ""); err != nil {
+		return nil, err
+	}
+	return w, nil
 }
 
-func flushToDisk(reserve *Reserve, data []byte) error {
-	if err := rotateLogDir(reserve); err != nil {
-		// Cannot operate in reserve dir
-		// Nothing to do below
-		return err
-	}
-	fn := "0_" + strconv.Itoa(int(time.Now().Unix())) + ".log"
-	filename := path.Join(reserve.Dir, fn)
-	return ioutil.WriteFile(filename, data, 0644)
+// evicted counts records of a file deleted to make room
+func (w *reserveWriter) evicted(f rotatedFile) {
+	if f.records < 0 {
+		// older versions do not keep the count in the name
+		f.records = 0
+		if rf, err := ReadReserveFile(f.path, w.keys); err == nil {
+			f.records = len(rf.Records)
+		}
+	}
+	w.metrics.observeEvicted(f.records)
 }
 
-func reserveRecords(logStorage []AccessRecord, reserve *Reserve) {
-	if reserve == nil {
-		log.Info("Reserving logs is disabled")
+func (w *reserveWriter) write(records []AccessRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	chunks, err := encodeReserve(records, w.encoding, w.maxSize)
+	if err != nil {
+		w.log.Error(err)
+		w.metrics.observeDropped("reserve_failed", len(records))
 		return
 	}
-	buf := bytes.NewBuffer([]byte{})
-	for _, lr := range logStorage {
-		prevSize := buf.Len()
-		b, _ := json.Marshal(lr)
-		if int64(prevSize) < maxSize && int64(prevSize)+int64(len(b)+1) >= maxSize {
-			if err := flushToDisk(reserve, buf.Bytes()); err != nil {
-				log.Error(err)
-				return
+	for i, chunk := range chunks {
+		err := w.rotation.makeRoom(int64(len(chunk.data)))
+		if err == nil {
+			err = writeFileAtomic(w.rotation.next(chunk.records), chunk.data)
+		}
+		if err != nil {
+			reason := "reserve_failed"
+			if err == errNoRoom {
+				reason = "reserve_full"
 			}
-			buf.Reset()
+			w.log.Error("Cannot reserve records: ", err)
+			for _, c := range chunks[i:] {
+				w.metrics.observeDropped(reason, c.records)
+			}
+			return
 		}
-		fmt.Fprintln(buf, b)
+		w.metrics.observeReserved(chunk.records)
+	}
+}
+
+// usage returns count and size of reserve files, nil writer has none
+func (w *reserveWriter) usage() (int, int64) {
+	if w == nil {
+		return 0, 0
+	}
+	w.mu.Lock()
+	files, err := w.rotation.files()
+	w.mu.Unlock()
+	if err != nil {
+		return 0, 0
 	}
-	if err := flushToDisk(reserve, buf.Bytes()); err != nil {
-		log.Error(err)
+	size := int64(0)
+	for _, f := range files {
+		size += f.size
+	}
+	return len(files), size
+}
+
+func (w *reserveWriter) close() {
+	if w == nil {
+		return
+	}
+	releaseDir(w.conf.Dir, "")
+}
+
+func (l *Logger) reserveRecords(logStorage []AccessRecord) {
+	if l.reserve == nil {
+		l.log.Info("Reserving logs is disabled")
+		l.metrics.observeDropped("reserve_disabled", len(logStorage))
 		return
 	}
-	buf.Reset()
+	l.reserve.write(logStorage)
 }
@@ -0,0 +1,51 @@
+package ECMSLogger
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ReserveKeys are ciphers of reserve files by key id
+type ReserveKeys map[string]cipher.AEAD
+
+// NewReserveKeys prepares every configured key, nil encryption gives no keys
+func NewReserveKeys(e *Encryption) (ReserveKeys, error) {
+	keys := ReserveKeys{}
+	if e == nil {
+		return keys, nil
+	}
+	for i, k := range e.Keys {
+		if k.ID == "" {
+			return nil, fmt.Errorf("key %d has no id", i)
+		}
+		if len(k.ID) > 255 {
+			return nil, fmt.Errorf("key id %q is longer than 255 bytes", k.ID)
+		}
+		if _, ok := keys[k.ID]; ok {
+			return nil, fmt.Errorf("key id %q is used twice", k.ID)
+		}
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not base64: %v", k.ID, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.ID, err)
+		}
+		keys[k.ID] = aead
+	}
+	if e.KeyID == "" {
+		return nil, errors.New("keyID is required")
+	}
+	if _, ok := keys[e.KeyID]; !ok {
+		return nil, fmt.Errorf("keyID %q is not in keys", e.KeyID)
+	}
+	return keys, nil
+}
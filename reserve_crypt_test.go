@@ -0,0 +1,116 @@
+package ECMSLogger
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "MDEyMzQ1Njc4OWFiY2RlZg=="                     // AES-128
+	testKey2 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=" // AES-256
+	testKey3 = "ZmVkY2JhOTg3NjU0MzIxMA=="                     // AES-128, not key1
+)
+
+func TestNewReserveKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		encryption *Encryption
+		keys       int
+		err        string
+	}{
+		{"no encryption", nil, 0, ""},
+		{"one key", &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: testKey1}}}, 1, ""},
+		{"rotated", &Encryption{KeyID: "k2", Keys: []ReserveKey{{ID: "k2", Key: testKey2}, {ID: "k1", Key: testKey1}}}, 2, ""},
+		{"no id", &Encryption{KeyID: "k1", Keys: []ReserveKey{{Key: testKey1}}}, 0, "has no id"},
+		{"long id", &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: strings.Repeat("k", 256), Key: testKey1}}}, 0, "longer than 255"},
+		{"same id", &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: testKey1}, {ID: "k1", Key: testKey2}}}, 0, "used twice"},
+		{"not base64", &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: "not base64!"}}}, 0, "not base64"},
+		{"wrong size", &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: "c2hvcnQ="}}}, 0, "invalid key size"},
+		{"no key id", &Encryption{Keys: []ReserveKey{{ID: "k1", Key: testKey1}}}, 0, "keyID is required"},
+		{"unknown key id", &Encryption{KeyID: "k2", Keys: []ReserveKey{{ID: "k1", Key: testKey1}}}, 0, "not in keys"},
+	} {
+		keys, err := NewReserveKeys(tt.encryption)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		case err == nil && len(keys) != tt.keys:
+			t.Errorf("%s: %d keys", tt.name, len(keys))
+		}
+	}
+}
+
+// writeEncrypted writes records to dir/name encrypted with the keyID of e
+func writeEncrypted(t *testing.T, dir, name string, e *Encryption, records []AccessRecord) string {
+	keys, err := NewReserveKeys(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := encodeReserve(records, newReserveEncoding(&Reserve{Compression: "gzip", Encryption: e}, keys), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := writeFileAtomic(filename, chunks[0].data); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReserveKeyRotation(t *testing.T) {
+	dir := testReserveDir(t)
+	defer os.RemoveAll(dir)
+	records := testRecords(700)
+	before := &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: testKey1}}}
+	after := &Encryption{KeyID: "k2", Keys: []ReserveKey{{ID: "k2", Key: testKey2}, {ID: "k1", Key: testKey1}}}
+	old := writeEncrypted(t, dir, "1_1600000000.log", before, records)
+	current := writeEncrypted(t, dir, "2_1600000001.log", after, records)
+
+	for _, tt := range []struct {
+		name   string
+		file   string
+		keys   *Encryption
+		keyID  string
+		err    string
+		broken bool
+	}{
+		{"old file with rotated keys", old, after, "k1", "", false},
+		{"new file with rotated keys", current, after, "k2", "", false},
+		{"new file with old keys", current, before, "", "key \"k2\" which is not configured", false},
+		{"without keys", old, nil, "", "key \"k1\" which is not configured", false},
+		{"wrong key under the same id", old, &Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: testKey3}}}, "k1", "", true},
+	} {
+		keys, err := NewReserveKeys(tt.keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf, err := ReadReserveFile(tt.file, keys)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if rf.KeyID != tt.keyID {
+			t.Errorf("%s: key id %q", tt.name, rf.KeyID)
+		}
+		if tt.broken {
+			// authentication fails for every block
+			if len(rf.Records) != 0 || len(rf.Corrupt) != 2 {
+				t.Errorf("%s: %d records, corrupt %v", tt.name, len(rf.Records), rf.Corrupt)
+			}
+			continue
+		}
+		if len(rf.Corrupt) > 0 || !reflect.DeepEqual(rf.Records, records) {
+			t.Errorf("%s: %d records, corrupt %v", tt.name, len(rf.Records), rf.Corrupt)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package ECMSLogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Reserve file layout, integers are big endian:
+//
+//	header: "ECRS" | format version uint8 | compression uint8 | schema version uint16
+//	        | key id length uint8 | key id
+//	block:  "ECRB" | payload length uint32 | records uint32 | CRC-32 uint32 | payload
+//
+// Payload is JSON lines of records compressed as a whole. The CRC covers
+// payload length, records and payload. Every block starts with the marker,
+// so the reader finds the next block after a broken one. Files with a key id
+// are encrypted with AES-GCM, the payload is nonce and sealed compressed
+// lines with the records count as additional data.
+//
+// Older versions wrote format 1, without key id, and format 2, always with
+// a key id. Their CRC covers only the payload.
+const (
+	plainFormatVersion     = 1
+	encryptedFormatVersion = 2
+	reserveFormatVersion   = 3
+	// ReserveSchemaVersion is the version of AccessRecord JSON in blocks. It
+	// grows when fields are renamed or change their type.
+	ReserveSchemaVersion = 1
+
+	reserveHeaderSize = 8
+	blockHeaderSize   = 16
+	// limits of a block before compression
+	maxBlockRecords = 500
+	maxBlockBytes   = 1 << 20
+
+	compressionNone = 0
+	compressionGzip = 1
+	compressionZstd = 2
+)
+
+var (
+	reserveMagic     = []byte("ECRS")
+	blockMagic       = []byte("ECRB")
+	compressionCodes = map[string]uint8{"none": compressionNone, "gzip": compressionGzip, "zstd": compressionZstd}
+	// zstd coders are safe for concurrent use and keep buffers between calls
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(64<<20))
+)
+
+type CorruptBlock struct {
+	// position of the block or, in JSON lines files, of the line
+	Offset int64
+	Err    error
+}
+
+// ReserveFile is the content of a reserve file. Records of corrupted blocks
+// are lost, the blocks are listed in Corrupt.
+type ReserveFile struct {
+	Name string
+	// 0 for JSON lines written by older versions
+	FormatVersion int
+	SchemaVersion int
+	Compression   string
+	// empty when the file is not encrypted
+	KeyID   string
+	Records []AccessRecord
+	Corrupt []CorruptBlock
+}
+
+// reserveEncoding is how blocks of new files are written
+type reserveEncoding struct {
+	compression uint8
+	keyID       string
+	aead        cipher.AEAD
+}
+
+func newReserveEncoding(r *Reserve, keys ReserveKeys) reserveEncoding {
+	code, ok := compressionCodes[r.Compression]
+	if !ok {
+		code = compressionCodes[DefaultCompression]
+	}
+	enc := reserveEncoding{compression: code}
+	if r.Encryption != nil {
+		enc.keyID = r.Encryption.KeyID
+		enc.aead = keys[enc.keyID]
+	}
+	return enc
+}
+
+func compressionName(code uint8) string {
+	for name, c := range compressionCodes {
+		if c == code {
+			return name
+		}
+	}
+	return strconv.Itoa(int(code))
+}
+
+func (enc reserveEncoding) header() []byte {
+	h := make([]byte, reserveHeaderSize)
+	copy(h, reserveMagic)
+	h[4] = reserveFormatVersion
+	h[5] = enc.compression
+	binary.BigEndian.PutUint16(h[6:], ReserveSchemaVersion)
+	keyID := ""
+	if enc.aead != nil {
+		keyID = enc.keyID
+	}
+	h = append(h, byte(len(keyID)))
+	return append(h, keyID...)
+}
+
+func (enc reserveEncoding) block(lines []byte, records int) ([]byte, error) {
+	payload, err := compress(enc.compression, lines)
+	if err != nil {
+		return nil, err
+	}
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(records))
+	if enc.aead != nil {
+		nonce := make([]byte, enc.aead.NonceSize(), enc.aead.NonceSize()+len(payload)+enc.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		payload = enc.aead.Seal(nonce, nonce, payload, count)
+	}
+	block := make([]byte, blockHeaderSize, blockHeaderSize+len(payload))
+	copy(block, blockMagic)
+	binary.BigEndian.PutUint32(block[4:], uint32(len(payload)))
+	copy(block[8:], count)
+	block = append(block, payload...)
+	binary.BigEndian.PutUint32(block[12:], blockChecksum(block[4:12], payload))
+	return block, nil
+}
+
+// blockChecksum covers length and records of the block header, so a damaged
+// count is not trusted
+func blockChecksum(header, payload []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(header), crc32.IEEETable, payload)
+}
+
+func compress(code uint8, data []byte) ([]byte, error) {
+	switch code {
+	case compressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case compressionGzip:
+	default:
+		return data, nil
+	}
+	var z bytes.Buffer
+	w := gzip.NewWriter(&z)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return z.Bytes(), nil
+}
+
+func decompress(code uint8, data []byte) ([]byte, error) {
+	switch code {
+	case compressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case compressionGzip:
+	default:
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+type reserveChunk struct {
+	data    []byte
+	records int
+}
+
+// encodeReserve packs records into files of at most maxSize bytes, maxSize
+// 0 means no limit. Blocks are not split between files.
+func encodeReserve(records []AccessRecord, enc reserveEncoding, maxSize int64) ([]reserveChunk, error) {
+	header := enc.header()
+	blockBytes := maxBlockBytes
+	if maxSize > 0 && maxSize < int64(blockBytes) {
+		blockBytes = int(maxSize)
+	}
+	files := []reserveChunk{}
+	var cur reserveChunk
+	var lines bytes.Buffer
+	n := 0
+	flushBlock := func() error {
+		if n == 0 {
+			return nil
+		}
+		block, err := enc.block(lines.Bytes(), n)
+		if err != nil {
+			return err
+		}
+		if maxSize > 0 && len(cur.data) > len(header) && int64(len(cur.data)+len(block)) > maxSize {
+			files = append(files, cur)
+			cur = reserveChunk{}
+		}
+		if cur.data == nil {
+			cur.data = append([]byte{}, header...)
+		}
+		cur.data = append(cur.data, block...)
+		cur.records += n
+		lines.Reset()
+		n = 0
+		return nil
+	}
+	for i := range records {
+		b, err := json.Marshal(&records[i])
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 && lines.Len()+len(b)+1 > blockBytes {
+			if err := flushBlock(); err != nil {
+				return nil, err
+			}
+		}
+		lines.Write(b)
+		lines.WriteByte('\n')
+		n++
+		if n >= maxBlockRecords {
+			if err := flushBlock(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flushBlock(); err != nil {
+		return nil, err
+	}
+	if cur.data != nil {
+		files = append(files, cur)
+	}
+	return files, nil
+}
+
+// ReadReserveFile reads a reserve file. Broken blocks are skipped and
+// reported in Corrupt, an error is returned only when the file cannot be
+// read at all. JSON lines files of older versions are read too. Encrypted
+// files need the key they were written with in keys.
+func ReadReserveFile(filename string, keys ReserveKeys) (*ReserveFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rf := &ReserveFile{Name: filename}
+	if !bytes.HasPrefix(data, reserveMagic) {
+		rf.Records, rf.Corrupt = readJSONLines(data)
+		return rf, nil
+	}
+	if len(data) < reserveHeaderSize {
+		return nil, errors.New(filename + ": truncated header")
+	}
+	rf.FormatVersion = int(data[4])
+	rf.SchemaVersion = int(binary.BigEndian.Uint16(data[6:]))
+	code := data[5]
+	rf.Compression = compressionName(code)
+	if rf.FormatVersion > reserveFormatVersion || rf.SchemaVersion > ReserveSchemaVersion {
+		return nil, fmt.Errorf("%s: format %d, schema %d is written by a newer version", filename, rf.FormatVersion, rf.SchemaVersion)
+	}
+	if _, ok := compressionCodes[rf.Compression]; !ok {
+		return nil, fmt.Errorf("%s: unknown compression %d", filename, code)
+	}
+	off := reserveHeaderSize
+	var aead cipher.AEAD
+	if rf.FormatVersion != plainFormatVersion {
+		if len(data) < off+1 || len(data) < off+1+int(data[off]) {
+			return nil, errors.New(filename + ": truncated header")
+		}
+		rf.KeyID = string(data[off+1 : off+1+int(data[off])])
+		off += 1 + len(rf.KeyID)
+		if aead = keys[rf.KeyID]; aead == nil && rf.KeyID != "" {
+			return nil, fmt.Errorf("%s: encrypted with key %q which is not configured", filename, rf.KeyID)
+		}
+	}
+	headerCRC := rf.FormatVersion >= reserveFormatVersion
+	for off < len(data) {
+		records, size, err := decodeBlock(data[off:], code, aead, headerCRC)
+		if err == nil {
+			rf.Records = append(rf.Records, records...)
+			off += size
+			continue
+		}
+		rf.Corrupt = append(rf.Corrupt, CorruptBlock{Offset: int64(off), Err: err})
+		next := bytes.Index(data[off+1:], blockMagic)
+		if next < 0 {
+			break
+		}
+		off += 1 + next
+	}
+	return rf, nil
+}
+
+// decodeBlock reads a block, headerCRC is set for formats whose CRC covers
+// the header fields
+func decodeBlock(data []byte, code uint8, aead cipher.AEAD, headerCRC bool) ([]AccessRecord, int, error) {
+	if len(data) < blockHeaderSize {
+		return nil, 0, errors.New("truncated block header")
+	}
+	if !bytes.Equal(data[:4], blockMagic) {
+		return nil, 0, errors.New("no block marker")
+	}
+	length := int(binary.BigEndian.Uint32(data[4:]))
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	if blockHeaderSize+length > len(data) {
+		return nil, 0, fmt.Errorf("truncated block, %d of %d bytes", len(data)-blockHeaderSize, length)
+	}
+	payload := data[blockHeaderSize : blockHeaderSize+length]
+	sum := crc32.ChecksumIEEE(payload)
+	if headerCRC {
+		sum = blockChecksum(data[4:12], payload)
+	}
+	if sum != binary.BigEndian.Uint32(data[12:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	// blocks are never written with more, a bigger count is damage which
+	// the CRC of older formats does not cover
+	if count > maxBlockRecords {
+		return nil, 0, fmt.Errorf("%d records, at most %d are written in a block", count, maxBlockRecords)
+	}
+	var err error
+	if aead != nil {
+		if len(payload) < aead.NonceSize() {
+			return nil, 0, errors.New("truncated nonce")
+		}
+		nonce := payload[:aead.NonceSize()]
+		if payload, err = aead.Open(nil, nonce, payload[len(nonce):], data[8:12]); err != nil {
+			return nil, 0, err
+		}
+	}
+	if payload, err = decompress(code, payload); err != nil {
+		return nil, 0, err
+	}
+	records := make([]AccessRecord, 0, count)
+	for _, line := range bytes.Split(payload, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		ar := AccessRecord{}
+		if err := json.Unmarshal(line, &ar); err != nil {
+			return nil, 0, fmt.Errorf("record %d: %v", len(records)+1, err)
+		}
+		records = append(records, ar)
+	}
+	if len(records) != count {
+		return nil, 0, fmt.Errorf("%d records instead of %d", len(records), count)
+	}
+	return records, blockHeaderSize + length, nil
+}
+
+// readJSONLines reads files written before the framed format. Besides JSON
+// lines it understands lines of decimal bytes like [123 34 ...].
+func readJSONLines(data []byte) ([]AccessRecord, []CorruptBlock) {
+	records := []AccessRecord{}
+	corrupt := []CorruptBlock{}
+	off := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		start := off
+		off += len(line) + 1
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var err error
+		if line[0] == '[' {
+			line, err = decodeByteList(line)
+		}
+		ar := AccessRecord{}
+		if err == nil {
+			err = json.Unmarshal(line, &ar)
+		}
+		if err != nil {
+			corrupt = append(corrupt, CorruptBlock{Offset: int64(start), Err: err})
+			continue
+		}
+		records = append(records, ar)
+	}
+	return records, corrupt
+}
+
+func decodeByteList(line []byte) ([]byte, error) {
+	fields := strings.Fields(strings.Trim(string(line), "[]"))
+	res := make([]byte, len(fields))
+	for i, f := range fields {
+		b, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = byte(b)
+	}
+	return res, nil
+}
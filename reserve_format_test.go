@@ -0,0 +1,85 @@
+package ECMSLogger
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadReserveFileDamagedCount(t *testing.T) {
+	enc := reserveEncoding{compression: compressionNone}
+	chunks, err := encodeReserve([]AccessRecord{{RequestID: "a"}, {RequestID: "b"}}, enc, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := chunks[0].data
+	count := data[len(enc.header())+8:]
+	binary.BigEndian.PutUint32(count, 0xfffffff0)
+
+	dir, err := ioutil.TempDir("", "reserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "damaged.log")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := ReadReserveFile(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rf.Records) != 0 || len(rf.Corrupt) != 1 || rf.Corrupt[0].Err.Error() != "checksum mismatch" {
+		t.Fatalf("records %d, corrupt %v", len(rf.Records), rf.Corrupt)
+	}
+
+	// format 1 checksums only the payload, the count is checked against the
+	// block limit instead
+	payload := []byte("{}\n")
+	legacy := append([]byte("ECRS"), plainFormatVersion, compressionNone, 0, 1)
+	block := make([]byte, blockHeaderSize)
+	copy(block, blockMagic)
+	binary.BigEndian.PutUint32(block[4:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(block[8:], 0xfffffff0)
+	binary.BigEndian.PutUint32(block[12:], crc32.ChecksumIEEE(payload))
+	legacy = append(append(legacy, block...), payload...)
+	if err := ioutil.WriteFile(filename, legacy, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = ReadReserveFile(filename, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(rf.Corrupt) != 1 || !strings.Contains(rf.Corrupt[0].Err.Error(), "at most 500") {
+		t.Fatalf("corrupt %v", rf.Corrupt)
+	}
+}
+
+func TestReserveCompression(t *testing.T) {
+	records := []AccessRecord{{RequestID: "a", Response: strings.Repeat("x", 1000)}, {RequestID: "b"}}
+	plain, err := encodeReserve(records, reserveEncoding{compression: compressionNone}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range compressionCodes {
+		enc := reserveEncoding{compression: code}
+		chunks, err := encodeReserve(records, enc, 0)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		block := chunks[0].data[len(enc.header()):]
+		got, _, err := decodeBlock(block, code, nil, true)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if len(got) != 2 || got[0].Response != records[0].Response || got[1].RequestID != "b" {
+			t.Fatalf("%s: %+v", name, got)
+		}
+		if code != compressionNone && len(chunks[0].data) >= len(plain[0].data)/2 {
+			t.Errorf("%s: %d bytes of %d are not compressed", name, len(chunks[0].data), len(plain[0].data))
+		}
+	}
+}
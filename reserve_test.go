@@ -0,0 +1,230 @@
+package ECMSLogger
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testReserveDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "reserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func testRecords(n int) []AccessRecord {
+	records := make([]AccessRecord, n)
+	for i := range records {
+		records[i] = AccessRecord{
+			Time:            time.Unix(1600000000+int64(i), 0).UTC(),
+			RequestID:       fmt.Sprint("request-", i),
+			Method:          "GET",
+			RequestURI:      fmt.Sprint("/items/", i),
+			Latitude:        52.5,
+			IsBot:           i%2 == 0,
+			DurationUs:      uint64(i) * 10,
+			Status:          200,
+			RequestHeaders:  map[string]string{"x-request-id": fmt.Sprint(i)},
+			ResponseHeaders: map[string]string{"content-type": "application/json"},
+		}
+	}
+	return records
+}
+
+func TestReserveRoundTrip(t *testing.T) {
+	dir := testReserveDir(t)
+	defer os.RemoveAll(dir)
+	keys, err := NewReserveKeys(&Encryption{KeyID: "k1", Keys: []ReserveKey{{ID: "k1", Key: "MDEyMzQ1Njc4OWFiY2RlZg=="}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := testRecords(1200)
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		for _, encrypted := range []bool{false, true} {
+			r := &Reserve{Compression: compression}
+			if encrypted {
+				r.Encryption = &Encryption{KeyID: "k1"}
+			}
+			chunks, err := encodeReserve(records, newReserveEncoding(r, keys), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(dir, fmt.Sprintf("%s_%v.log", compression, encrypted))
+			if err := writeFileAtomic(filename, chunks[0].data); err != nil {
+				t.Fatal(err)
+			}
+			rf, err := ReadReserveFile(filename, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rf.Corrupt) > 0 {
+				t.Fatalf("%s, encrypted %v: %v", compression, encrypted, rf.Corrupt)
+			}
+			if rf.Compression != compression || (rf.KeyID != "") != encrypted {
+				t.Errorf("%s, encrypted %v: header %+v", compression, encrypted, rf)
+			}
+			if !reflect.DeepEqual(rf.Records, records) {
+				t.Errorf("%s, encrypted %v: records differ", compression, encrypted)
+			}
+		}
+	}
+}
+
+func TestReserveSeqContinues(t *testing.T) {
+	dir := testReserveDir(t)
+	defer os.RemoveAll(dir)
+	// files of the previous version, 1 is older than 0
+	for i := 0; i < 2; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d_%d.log", i, 1600000000-i))
+		if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("{\"requestID\":\"legacy-%d\"}\n", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf := &Reserve{Dir: dir, Rotate: RotateConf{MaxFiles: 100, MaxSize: "1m"}, Compression: "gzip"}
+	writer := func() *reserveWriter {
+		w, err := newReserveWriter(conf, log.NewEntry(log.StandardLogger()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.metrics = newMetrics(nil)
+		return w
+	}
+	w := writer()
+	w.write(testRecords(3))
+	w.close()
+
+	// a restart continues numbering, flushes running at once get their own
+	// numbers
+	w = writer()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.write(testRecords(2))
+		}()
+	}
+	wg.Wait()
+	w.close()
+
+	files, err := listRotated(dir, "", ".log", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 11 {
+		t.Fatalf("%d files", len(files))
+	}
+	if files[0].seq != -2 || files[1].seq != -1 {
+		t.Errorf("legacy files are not the oldest: %+v", files[:2])
+	}
+	for i, f := range files[2:] {
+		if f.seq != int64(i+1) {
+			t.Errorf("file %d has seq %d", i, f.seq)
+		}
+	}
+	names, err := ReserveFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"legacy-1", "legacy-0"} {
+		rf, err := ReadReserveFile(names[i], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rf.FormatVersion != 0 || len(rf.Records) != 1 || rf.Records[0].RequestID != want {
+			t.Errorf("%s: %+v", names[i], rf)
+		}
+	}
+	rf, err := ReadReserveFile(names[2], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rf.Records, testRecords(3)) {
+		t.Errorf("%s: records differ", names[2])
+	}
+}
+
+func TestReserveFull(t *testing.T) {
+	// batches differ only in request ids, so their uncompressed files have
+	// the same size
+	batch := func(i int) []AccessRecord {
+		records := testRecords(2)
+		for j := range records {
+			records[j].RequestID = fmt.Sprint("batch-", i)
+		}
+		return records
+	}
+	chunks, err := encodeReserve(batch(0), newReserveEncoding(&Reserve{Compression: "none"}, nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	threeFiles := fmt.Sprint(3*len(chunks[0].data), "b")
+	for _, tt := range []struct {
+		name    string
+		reserve Reserve
+		// set before the last batch, the disk is never that free
+		minFreePercent float64
+		kept           []string
+		evicted        uint64
+		full           uint64
+	}{
+		{"evict over total size", Reserve{MaxTotalSize: threeFiles}, 0, []string{"batch-2", "batch-3", "batch-4"}, 4, 0},
+		{"stop over total size", Reserve{MaxTotalSize: threeFiles, OnFull: ReserveStop}, 0, []string{"batch-0", "batch-1", "batch-2"}, 0, 4},
+		{"evict over max files", Reserve{Rotate: RotateConf{MaxFiles: 2}}, 0, []string{"batch-3", "batch-4"}, 6, 0},
+		{"stop over max files", Reserve{Rotate: RotateConf{MaxFiles: 2}, OnFull: ReserveStop}, 0, []string{"batch-0", "batch-1"}, 0, 6},
+		{"evict for free space", Reserve{}, 99.99, []string{}, 8, 2},
+		{"stop for free space", Reserve{OnFull: ReserveStop}, 99.99, []string{"batch-0", "batch-1", "batch-2", "batch-3"}, 0, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testReserveDir(t)
+			defer os.RemoveAll(dir)
+			if _, _, ok := diskSpace(dir); !ok && tt.minFreePercent > 0 {
+				t.Skip("free space is unknown")
+			}
+			conf := tt.reserve
+			conf.Dir = dir
+			conf.Compression = "none"
+			conf.Rotate.MaxSize = "1m"
+			if conf.Rotate.MaxFiles == 0 {
+				conf.Rotate.MaxFiles = 100
+			}
+			w, err := newReserveWriter(&conf, log.NewEntry(log.StandardLogger()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.metrics = newMetrics(nil)
+			for i := 0; i < 5; i++ {
+				if i == 4 {
+					w.rotation.minFreePercent = tt.minFreePercent
+				}
+				w.write(batch(i))
+			}
+			w.close()
+
+			kept := []string{}
+			for _, r := range readReserve(t, dir) {
+				if len(kept) == 0 || kept[len(kept)-1] != r.RequestID {
+					kept = append(kept, r.RequestID)
+				}
+			}
+			if !reflect.DeepEqual(kept, tt.kept) {
+				t.Errorf("kept %v, want %v", kept, tt.kept)
+			}
+			m := w.metrics
+			if m.evictedRecords != tt.evicted || m.dropped["reserve_evicted"] != tt.evicted || m.evictedFiles != tt.evicted/2 {
+				t.Errorf("evicted %d files with %d records", m.evictedFiles, m.evictedRecords)
+			}
+			if n := m.dropped["reserve_full"]; n != tt.full {
+				t.Errorf("%d records dropped as full, want %d", n, tt.full)
+			}
+		})
+	}
+}
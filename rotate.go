@@ -0,0 +1,281 @@
+package ECMSLogger
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rotated files are named <prefix><seq>_<unix time>[_<records>]<ext>[.gz].
+// seq grows with every file and is padded, so names sort in write order and
+// nothing is renamed on rotation. Reserve files of older versions were named
+// <index>_<unix time>.log with index 0 for the newest one.
+const (
+	rotatedSeqDigits = 12
+	gzipExt          = ".gz"
+)
+
+// errNoRoom is returned when a new file does not fit into limits and the
+// policy does not allow deletion
+var errNoRoom = errors.New("no room for a new file")
+
+// dirs of running rotations. Two rotations sharing files would delete
+// files of each other.
+var (
+	rotatedDirsMu sync.Mutex
+	rotatedDirs   = map[string]bool{}
+)
+
+func claimDir(dir, prefix string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	rotatedDirsMu.Lock()
+	defer rotatedDirsMu.Unlock()
+	if rotatedDirs[abs+"/"+prefix] {
+		return errors.New("Dir " + dir + " is used by another logger")
+	}
+	rotatedDirs[abs+"/"+prefix] = true
+	return nil
+}
+
+func releaseDir(dir, prefix string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	rotatedDirsMu.Lock()
+	delete(rotatedDirs, abs+"/"+prefix)
+	rotatedDirsMu.Unlock()
+}
+
+type rotatedFile struct {
+	path string
+	// sequence number, negative for reserve files of older versions
+	seq     int64
+	created time.Time
+	// -1 when unknown
+	records    int
+	size       int64
+	compressed bool
+}
+
+func parseRotatedName(name, prefix, ext string, legacy bool) (rotatedFile, bool) {
+	f := rotatedFile{records: -1}
+	if !strings.HasPrefix(name, prefix) {
+		return f, false
+	}
+	name = strings.TrimPrefix(name, prefix)
+	if strings.HasSuffix(name, ext+gzipExt) {
+		f.compressed = true
+		name = strings.TrimSuffix(name, gzipExt)
+	}
+	if !strings.HasSuffix(name, ext) {
+		return f, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name, ext), "_")
+	if len(parts) < 2 || len(parts) > 3 {
+		return f, false
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return f, false
+	}
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return f, false
+	}
+	f.created = time.Unix(unix, 0)
+	if len(parts[0]) != rotatedSeqDigits {
+		if !legacy || len(parts) != 2 {
+			return f, false
+		}
+		// index of the old rotation, bigger is older
+		f.seq = -1 - seq
+		return f, true
+	}
+	f.seq = seq
+	if len(parts) == 3 {
+		if f.records, err = strconv.Atoi(parts[2]); err != nil {
+			return f, false
+		}
+	}
+	return f, true
+}
+
+// listRotated returns files of dir, the oldest first
+func listRotated(dir, prefix, ext string, legacy bool) ([]rotatedFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []rotatedFile{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		f, ok := parseRotatedName(info.Name(), prefix, ext, legacy)
+		if !ok {
+			continue
+		}
+		f.path = path.Join(dir, info.Name())
+		f.size = info.Size()
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].seq != files[j].seq {
+			return files[i].seq < files[j].seq
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
+
+// rotation keeps files of a dir within count, total size, age and free disk
+// limits, zero limits are not checked
+type rotation struct {
+	dir    string
+	prefix string
+	ext    string
+	// list reserve files of older versions too
+	legacy         bool
+	maxFiles       int
+	maxTotalSize   int64
+	maxAge         time.Duration
+	minFreePercent float64
+	// fail instead of deleting files when there is no room
+	stop bool
+	// called before a file is deleted to make room or by age
+	onEvict func(f rotatedFile)
+	log     *log.Entry
+	// sequence number of the last file
+	seq int64
+}
+
+// init continues numbering of files left by the previous run
+func (r *rotation) init() error {
+	files, err := r.files()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 && files[len(files)-1].seq > 0 {
+		r.seq = files[len(files)-1].seq
+	}
+	return nil
+}
+
+func (r *rotation) files() ([]rotatedFile, error) {
+	return listRotated(r.dir, r.prefix, r.ext, r.legacy)
+}
+
+// next returns the path of a new file, records < 0 are left out of the name
+func (r *rotation) next(records int) string {
+	r.seq++
+	name := fmt.Sprintf("%s%0*d_%d", r.prefix, rotatedSeqDigits, r.seq, time.Now().Unix())
+	if records >= 0 {
+		name += "_" + strconv.Itoa(records)
+	}
+	return path.Join(r.dir, name+r.ext)
+}
+
+func (r *rotation) evict(f rotatedFile, reason string) error {
+	if r.onEvict != nil {
+		r.onEvict(f)
+	}
+	if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	r.log.Warning(reason, ", deleted ", f.path)
+	return nil
+}
+
+// makeRoom deletes files older than maxAge and checks that one more file of
+// size fits into the limits. Unless the policy is stop, the oldest files are
+// deleted until it does.
+func (r *rotation) makeRoom(size int64) error {
+	files, err := r.files()
+	if err != nil {
+		return err
+	}
+	if r.maxAge > 0 {
+		for len(files) > 0 && time.Since(files[0].created) > r.maxAge {
+			if err := r.evict(files[0], "Expired"); err != nil {
+				return err
+			}
+			files = files[1:]
+		}
+	}
+	total := size
+	for _, f := range files {
+		total += f.size
+	}
+	// bytes to free to keep minFreePercent of the disk
+	need := int64(0)
+	if r.minFreePercent > 0 {
+		if free, disk, ok := diskSpace(r.dir); ok {
+			need = int64(float64(disk)*r.minFreePercent/100) - (free - size)
+		}
+	}
+	full := func() bool {
+		return (r.maxFiles > 0 && len(files)+1 > r.maxFiles) || (r.maxTotalSize > 0 && total > r.maxTotalSize) || need > 0
+	}
+	if !full() {
+		return nil
+	}
+	if r.stop {
+		return errNoRoom
+	}
+	for len(files) > 0 && full() {
+		if err := r.evict(files[0], "No room"); err != nil {
+			return err
+		}
+		total -= files[0].size
+		need -= files[0].size
+		files = files[1:]
+	}
+	if full() {
+		return errNoRoom
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a hidden temporary file and renames it, so
+// readers never see a partial file
+func writeFileAtomic(filename string, data []byte) error {
+	dir, name := filepath.Split(filename)
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// persist the rename, not supported everywhere
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
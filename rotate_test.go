@@ -0,0 +1,34 @@
+package ECMSLogger
+
+import (
+	"testing"
+)
+
+func TestParseRotatedName(t *testing.T) {
+	tests := []struct {
+		name    string
+		legacy  bool
+		ok      bool
+		seq     int64
+		records int
+		gz      bool
+	}{
+		{"000000000042_1600000000_17.log", false, true, 42, 17, false},
+		{"000000000042_1600000000.log.gz", false, true, 42, -1, true},
+		{"3_1600000000.log", true, true, -4, -1, false},
+		{"3_1600000000.log", false, false, 0, 0, false},
+		{"3_1600000000_5.log", true, false, 0, 0, false},
+		{".000000000042_1600000000_17.log.tmp", true, false, 0, 0, false},
+		{"000000000042_1600000000_17.txt", true, false, 0, 0, false},
+	}
+	for _, tt := range tests {
+		f, ok := parseRotatedName(tt.name, "", ".log", tt.legacy)
+		if ok != tt.ok {
+			t.Errorf("%s: ok %v", tt.name, ok)
+			continue
+		}
+		if ok && (f.seq != tt.seq || f.records != tt.records || f.compressed != tt.gz || f.created.Unix() != 1600000000) {
+			t.Errorf("%s: %+v", tt.name, f)
+		}
+	}
+}
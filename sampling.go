@@ -0,0 +1,175 @@
+package ECMSLogger
+
+import (
+	"errors"
+	"google.golang.org/grpc/codes"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sampleRule struct {
+	path      *regexp.Regexp
+	methods   []string
+	status    []string
+	rpcCodes  []string
+	userAgent *regexp.Regexp
+	skip      bool
+	rate      float64
+}
+
+type Sampler struct {
+	rules       []sampleRule
+	defaultRate float64
+	keepErrors  bool
+	slowerThan  time.Duration
+}
+
+func NewSampler(s *Sampling) (*Sampler, error) {
+	sm := &Sampler{
+		defaultRate: 1,
+		keepErrors:  s.KeepErrors,
+		slowerThan:  s.SlowerThan,
+	}
+	if s.DefaultRate != nil {
+		sm.defaultRate = *s.DefaultRate
+	}
+	if sm.defaultRate < 0 || sm.defaultRate > 1 {
+		return nil, errors.New("Sampling defaultRate must be in [0, 1]")
+	}
+	for i, r := range s.Rules {
+		rule := sampleRule{skip: r.Skip, rate: 1}
+		if r.Rate != nil {
+			if *r.Rate < 0 || *r.Rate > 1 {
+				return nil, errors.New("Sampling rule " + strconv.Itoa(i) + ": rate must be in [0, 1]")
+			}
+			rule.rate = *r.Rate
+		}
+		if r.Path != "" {
+			rule.path = globToRegexp(r.Path)
+		}
+		for _, m := range r.Methods {
+			rule.methods = append(rule.methods, strings.ToUpper(m))
+		}
+		for _, st := range r.Status {
+			st = strings.ToLower(st)
+			if !statusPattern.MatchString(st) {
+				return nil, errors.New("Sampling rule " + strconv.Itoa(i) + ": wrong status " + st)
+			}
+			rule.status = append(rule.status, st)
+		}
+		for _, code := range r.RPCCodes {
+			if !validRPCCode(code) {
+				return nil, errors.New("Sampling rule " + strconv.Itoa(i) + ": wrong gRPC code " + code)
+			}
+			rule.rpcCodes = append(rule.rpcCodes, code)
+		}
+		if r.UserAgent != "" {
+			re, err := regexp.Compile(r.UserAgent)
+			if err != nil {
+				return nil, errors.New("Sampling rule " + strconv.Itoa(i) + ": " + err.Error())
+			}
+			rule.userAgent = re
+		}
+		sm.rules = append(sm.rules, rule)
+	}
+	return sm, nil
+}
+
+var statusPattern = regexp.MustCompile(`^[1-5][0-9x][0-9x]$`)
+
+// globToRegexp converts path glob: `*` matches inside one segment, `**`
+// matches any number of segments, `?` matches one character
+func globToRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func (r *sampleRule) match(ar *AccessRecord) bool {
+	if r.path != nil && !r.path.MatchString(recordPath(ar)) {
+		return false
+	}
+	if len(r.methods) > 0 && !StringInSlice(ar.Method, r.methods) {
+		return false
+	}
+	if len(r.status) > 0 && !statusMatch(ar.Status, r.status) {
+		return false
+	}
+	if len(r.rpcCodes) > 0 && !StringInSlice(ar.RPCCode, r.rpcCodes) {
+		return false
+	}
+	if r.userAgent != nil && !r.userAgent.MatchString(ar.UserAgent) {
+		return false
+	}
+	return true
+}
+
+func recordPath(ar *AccessRecord) string {
+	return strings.SplitN(ar.RequestURI, "?", 2)[0]
+}
+
+func statusMatch(status uint16, patterns []string) bool {
+	s := strconv.Itoa(int(status))
+	for _, p := range patterns {
+		matched := len(s) == len(p)
+		for i := 0; matched && i < len(p); i++ {
+			if p[i] != 'x' && p[i] != s[i] {
+				matched = false
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep decides whether the finished request should be logged and stores the
+// sample rate into the record, so aggregates can be re-weighted with
+// 1/sample_rate. Errors and slow requests bypass every rule when configured.
+func (s *Sampler) Keep(ar *AccessRecord) bool {
+	ar.SampleRate = 1
+	if s == nil {
+		return true
+	}
+	if s.keepErrors && (ar.Status >= 500 || ar.Error != "" || (ar.RPCCode != "" && ar.RPCCode != codes.OK.String())) {
+		return true
+	}
+	if s.slowerThan > 0 && time.Duration(ar.DurationUs)*time.Microsecond >= s.slowerThan {
+		return true
+	}
+	rate := s.defaultRate
+	for _, r := range s.rules {
+		if !r.match(ar) {
+			continue
+		}
+		if r.skip {
+			return false
+		}
+		rate = r.rate
+		break
+	}
+	ar.SampleRate = rate
+	if rate >= 1 {
+		return true
+	}
+	return rate > 0 && rand.Float64() < rate
+}
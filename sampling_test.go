@@ -0,0 +1,123 @@
+package ECMSLogger
+
+import (
+	"testing"
+	"time"
+)
+
+func rate(r float64) *float64 {
+	return &r
+}
+
+func TestSamplerRules(t *testing.T) {
+	sampling := &Sampling{
+		Rules: []SampleRule{
+			{Path: "/healthz", Skip: true},
+			{Path: "/v1/static/**", Rate: rate(0)},
+			{Path: "/v1/*/list", Methods: []string{"get"}, Rate: rate(0.5)},
+			{Status: []string{"3xx", "404"}, Rate: rate(0.1)},
+			{UserAgent: "^kube-probe/", Skip: true},
+			{RPCCodes: []string{"OK"}, Rate: rate(0.2)},
+		},
+		DefaultRate: rate(0.9),
+		KeepErrors:  true,
+		SlowerThan:  time.Second,
+	}
+	s, err := NewSampler(sampling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		ar   AccessRecord
+		// -1 when the record is skipped
+		rate float64
+	}{
+		{"skipped path", AccessRecord{RequestURI: "/healthz?full=1", Method: "GET", Status: 200}, -1},
+		{"nested glob", AccessRecord{RequestURI: "/v1/static/css/site.css", Method: "GET", Status: 200}, 0},
+		{"segment glob", AccessRecord{RequestURI: "/v1/users/list", Method: "GET", Status: 200}, 0.5},
+		{"segment glob does not cross /", AccessRecord{RequestURI: "/v1/users/all/list", Method: "GET", Status: 200}, 0.9},
+		{"other method", AccessRecord{RequestURI: "/v1/users/list", Method: "POST", Status: 200}, 0.9},
+		{"status mask", AccessRecord{RequestURI: "/v1/a", Method: "GET", Status: 302}, 0.1},
+		{"exact status", AccessRecord{RequestURI: "/v1/a", Method: "GET", Status: 404}, 0.1},
+		{"user agent", AccessRecord{RequestURI: "/v1/a", Method: "GET", Status: 200, UserAgent: "kube-probe/1.27"}, -1},
+		{"default", AccessRecord{RequestURI: "/v1/a", Method: "GET", Status: 200}, 0.9},
+		{"rpc code", AccessRecord{RequestURI: "/pkg.Users/Get", Method: grpcUnaryMethod, RPCCode: "OK"}, 0.2},
+		// errors and slow requests bypass rules, skip included
+		{"server error", AccessRecord{RequestURI: "/healthz", Method: "GET", Status: 503}, 1},
+		{"handler error", AccessRecord{RequestURI: "/v1/static/a", Method: "GET", Status: 200, Error: "failed"}, 1},
+		{"slow", AccessRecord{RequestURI: "/healthz", Method: "GET", Status: 200, DurationUs: 1500000}, 1},
+		{"rpc error", AccessRecord{RequestURI: "/pkg.Users/Get", Method: grpcUnaryMethod, RPCCode: "NotFound"}, 1},
+	} {
+		ar := tt.ar
+		kept := s.Keep(&ar)
+		switch {
+		case tt.rate < 0:
+			if kept {
+				t.Errorf("%s: kept", tt.name)
+			}
+		case tt.rate == 0:
+			if kept || ar.SampleRate != 0 {
+				t.Errorf("%s: kept %v with rate %v", tt.name, kept, ar.SampleRate)
+			}
+		case tt.rate == 1:
+			if !kept || ar.SampleRate != 1 {
+				t.Errorf("%s: kept %v with rate %v", tt.name, kept, ar.SampleRate)
+			}
+		case ar.SampleRate != tt.rate:
+			t.Errorf("%s: rate %v, want %v", tt.name, ar.SampleRate, tt.rate)
+		}
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	for _, r := range []float64{0.1, 0.5, 0.9} {
+		s, err := NewSampler(&Sampling{DefaultRate: rate(r)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := 0
+		const n = 20000
+		for i := 0; i < n; i++ {
+			if s.Keep(&AccessRecord{Status: 200}) {
+				kept++
+			}
+		}
+		// far more than 5 standard deviations
+		if got := float64(kept) / n; got < r-0.03 || got > r+0.03 {
+			t.Errorf("rate %v keeps %v", r, got)
+		}
+	}
+}
+
+func TestSamplerWithoutConfig(t *testing.T) {
+	var nilSampler *Sampler
+	empty, err := NewSampler(&Sampling{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*Sampler{nilSampler, empty} {
+		ar := AccessRecord{SampleRate: 0.5}
+		if !s.Keep(&ar) || ar.SampleRate != 1 {
+			t.Errorf("%v: rate %v", s, ar.SampleRate)
+		}
+	}
+}
+
+func TestNewSamplerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sampling Sampling
+	}{
+		{"default rate", Sampling{DefaultRate: rate(1.5)}},
+		{"rule rate", Sampling{Rules: []SampleRule{{Rate: rate(-0.1)}}}},
+		{"status", Sampling{Rules: []SampleRule{{Status: []string{"6xx"}}}}},
+		{"status length", Sampling{Rules: []SampleRule{{Status: []string{"20"}}}}},
+		{"user agent", Sampling{Rules: []SampleRule{{UserAgent: "(bot"}}}},
+		{"rpc code", Sampling{Rules: []SampleRule{{RPCCodes: []string{"NOT_FOUND"}}}}},
+	} {
+		if _, err := NewSampler(&tt.sampling); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
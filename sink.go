@@ -0,0 +1,53 @@
+package ECMSLogger
+
+// Sink is a destination of records besides ClickHouse. Send must not block
+// the request for long, sinks usually queue records.
+type Sink interface {
+	Send(ar AccessRecord)
+	Close() error
+}
+
+// newSinks starts sinks enabled in config
+func newSinks(config *Sinks, metrics *Metrics) ([]Sink, error) {
+	sinks := []Sink{}
+	if config.File != nil {
+		s, err := newFileSink(config.File, metrics)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if config.Stdout != nil {
+		s, err := newStdoutSink(config.Stdout, metrics)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if config.Kafka != nil {
+		s, err := newKafkaSink(config.Kafka, metrics)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+func closeSinks(sinks []Sink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
+
+// send passes a redacted record to ClickHouse and every sink
+func (m *Middleware) send(ar AccessRecord) {
+	if m.Logger != nil {
+		m.Logger.Send(ar)
+	}
+	for _, s := range m.Sinks {
+		s.Send(ar)
+	}
+}
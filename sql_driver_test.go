@@ -0,0 +1,56 @@
+package ECMSLogger
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+// beginConn supports only the Begin of old drivers
+type beginConn struct {
+	begun int
+}
+
+func (c *beginConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *beginConn) Close() error {
+	return nil
+}
+
+func (c *beginConn) Begin() (driver.Tx, error) {
+	c.begun++
+	return beginTx{}, nil
+}
+
+type beginTx struct{}
+
+func (beginTx) Commit() error {
+	return nil
+}
+
+func (beginTx) Rollback() error {
+	return nil
+}
+
+func TestTimedConnBeginTx(t *testing.T) {
+	conn := &beginConn{}
+	c := &timedConn{conn}
+	if _, err := c.BeginTx(context.Background(), driver.TxOptions{}); err != nil || conn.begun != 1 {
+		t.Fatalf("default options: %v", err)
+	}
+	for _, opts := range []driver.TxOptions{
+		{Isolation: driver.IsolationLevel(sql.LevelSerializable)},
+		{ReadOnly: true},
+	} {
+		if _, err := c.BeginTx(context.Background(), opts); err == nil {
+			t.Errorf("%+v is accepted", opts)
+		}
+	}
+	if conn.begun != 1 {
+		t.Errorf("Begin is called for unsupported options")
+	}
+}
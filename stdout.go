@@ -0,0 +1,97 @@
+package ECMSLogger
+
+import (
+	"bufio"
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+)
+
+// StdoutSink writes a JSON line per record to stdout or stderr, where
+// container log collectors pick them up
+type StdoutSink struct {
+	format  recordFormatter
+	metrics *Metrics
+	log     *log.Entry
+	records chan AccessRecord
+	w       *bufio.Writer
+
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+}
+
+func newStdoutSink(conf *StdoutSinkConf, metrics *Metrics) (*StdoutSink, error) {
+	format, err := newJSONFormatter(conf.Naming, conf.Fields, conf.OmitEmpty)
+	if err != nil {
+		return nil, err
+	}
+	var out io.Writer = os.Stdout
+	if conf.Stream == "stderr" {
+		out = os.Stderr
+	}
+	s := &StdoutSink{
+		format:  format,
+		metrics: metrics,
+		log:     log.WithField("sink", conf.Stream),
+		records: make(chan AccessRecord, conf.QueueSize),
+		w:       bufio.NewWriter(out),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queues the record, it is dropped when the queue is full
+func (s *StdoutSink) Send(ar AccessRecord) {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		s.metrics.observeDropped("closed", 1)
+		return
+	}
+	select {
+	case s.records <- ar:
+	default:
+		s.metrics.observeDropped("stdout_queue_full", 1)
+	}
+}
+
+// Close writes queued records
+func (s *StdoutSink) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.records)
+	s.closeMu.Unlock()
+	<-s.done
+	return s.w.Flush()
+}
+
+func (s *StdoutSink) run() {
+	defer close(s.done)
+	var buf bytes.Buffer
+	for ar := range s.records {
+		buf.Reset()
+		if err := s.format(&buf, &ar); err != nil {
+			s.log.Error(err)
+			s.metrics.observeDropped("stdout_failed", 1)
+			continue
+		}
+		if _, err := s.w.Write(buf.Bytes()); err != nil {
+			s.log.Error(err)
+			s.metrics.observeDropped("stdout_failed", 1)
+		}
+		// a line should not wait for the next request
+		if len(s.records) == 0 {
+			if err := s.w.Flush(); err != nil {
+				s.log.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package ECMSLogger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStdoutSink(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		conf StdoutSinkConf
+		want string
+	}{
+		{"snake fields", StdoutSinkConf{Fields: []string{"time", "request_uri", "status", "user"}},
+			`{"time":"2024-03-01T10:20:30Z","request_uri":"/v1/items?q=a b","user":"alice","status":200}` + "\n"},
+		{"camel fields", StdoutSinkConf{Naming: NamingCamel, Fields: []string{"requestURI", "durationUs", "requestHeaders"}},
+			`{"requestURI":"/v1/items?q=a b","durationUs":1500,"requestHeaders":{"Referer":"https://example.com/"}}` + "\n"},
+		{"omit empty", StdoutSinkConf{Fields: []string{"method", "host", "is_bot", "duration_us", "latitude"}, OmitEmpty: true},
+			`{"method":"GET","duration_us":1500}` + "\n"},
+		{"stderr", StdoutSinkConf{Stream: "stderr", Naming: NamingCamel, Fields: []string{"remoteAddr", "userAgent"}},
+			`{"remoteAddr":"203.0.113.9","userAgent":"curl/8.0 \"x\""}` + "\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Sinks: Sinks{Stdout: &tt.conf}}
+			errs := ValidationErrors{}
+			c.validateStdoutSink(&errs)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			f, err := ioutil.TempFile("", "stdout")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			// the sink takes its stream when created
+			stream := &os.Stdout
+			if tt.conf.Stream == "stderr" {
+				stream = &os.Stderr
+			}
+			saved := *stream
+			*stream = f
+			s, err := newStdoutSink(c.Sinks.Stdout, newMetrics(nil))
+			*stream = saved
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Send(formatTestRecord)
+			s.Send(formatTestRecord)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tt.want+tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want+tt.want)
+			}
+		})
+	}
+}
+
+func TestStdoutSinkClosed(t *testing.T) {
+	s, err := newStdoutSink(&StdoutSinkConf{Stream: "stdout", Naming: NamingSnake, Fields: []string{"status"}, QueueSize: 1}, newMetrics(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s.Send(formatTestRecord)
+	if n := s.metrics.dropped["closed"]; n != 1 {
+		t.Errorf("%d dropped", n)
+	}
+}
@@ -0,0 +1,72 @@
+package ECMSLogger
+
+import (
+	"context"
+	"time"
+)
+
+type SpanKind int
+
+const (
+	SpanDB SpanKind = iota
+	SpanRedis
+)
+
+// slowest query text is cut to keep records small
+const maxQueryLength = 1024
+
+// AddDBDuration accumulates time spent in the database. Unlike
+// SetDBDurationUs it is safe to call for every query, also concurrently.
+func (l *RequestLog) AddDBDuration(query string, dur time.Duration) {
+	if l == nil {
+		return
+	}
+	us := uint64(dur.Microseconds())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.DBDurationUs += us
+	l.record.DBQueries++
+	if us >= l.record.DBSlowestUs {
+		l.record.DBSlowestUs = us
+		if len(query) > maxQueryLength {
+			query = query[:maxQueryLength]
+		}
+		l.record.DBSlowestQuery = query
+	}
+}
+
+// AddRedisDuration accumulates time spent in redis on top of the session lookup
+func (l *RequestLog) AddRedisDuration(dur time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.RedisDurationUs += uint64(dur.Microseconds())
+	l.record.RedisCalls++
+}
+
+// StartSpan starts timing of a call and returns the function stopping it:
+//
+//	defer ECMSLogger.FromContext(ctx).StartSpan(ECMSLogger.SpanRedis, "GET")()
+//
+// It is a no-op for requests which are not logged.
+func (l *RequestLog) StartSpan(kind SpanKind, name string) func() {
+	if l == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		switch kind {
+		case SpanDB:
+			l.AddDBDuration(name, time.Since(start))
+		case SpanRedis:
+			l.AddRedisDuration(time.Since(start))
+		}
+	}
+}
+
+// StartSpan is a shortcut for FromContext(ctx).StartSpan
+func StartSpan(ctx context.Context, kind SpanKind, name string) func() {
+	return FromContext(ctx).StartSpan(kind, name)
+}
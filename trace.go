@@ -0,0 +1,145 @@
+package ECMSLogger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	maxRequestIDLength     = 128
+	traceparentHeader      = "Traceparent"
+	tracestateHeader       = "Tracestate"
+	b3Header               = "B3"
+)
+
+func newID(bytes int) string {
+	b := make([]byte, bytes)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", bytes*2)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func isLowerHex(s string, size int) bool {
+	if len(s) != size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return strings.Trim(s, "0") != ""
+}
+
+// ParseTraceparent parses W3C traceparent header
+// `version-traceid-parentid-flags`. Unknown future versions are accepted as
+// long as the first four fields are valid.
+func ParseTraceparent(h string) (traceID string, parentID string, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 {
+		return "", "", "", false
+	}
+	version := parts[0]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	if !isLowerHex(parts[1], 32) || !isLowerHex(parts[2], 16) || len(parts[3]) != 2 {
+		return "", "", "", false
+	}
+	if _, err := hex.DecodeString(parts[3]); err != nil {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// ParseB3 parses Zipkin B3 propagation of callers without traceparent: the
+// single b3 header `traceid-spanid[-sampled[-parentspanid]]` or the
+// X-B3-TraceId, X-B3-SpanId and X-B3-Sampled headers. 64-bit trace ids are
+// padded to 128 bits as in W3C trace context. Flags are 00 when the caller
+// did not sample the trace.
+func ParseB3(h http.Header) (traceID string, parentID string, flags string, ok bool) {
+	sampled := ""
+	if single := strings.TrimSpace(h.Get(b3Header)); single != "" {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 || len(parts) > 4 {
+			return "", "", "", false
+		}
+		traceID, parentID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceID, parentID = h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId")
+		sampled = h.Get("X-B3-Sampled")
+		if h.Get("X-B3-Flags") == "1" {
+			sampled = "d"
+		}
+	}
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) {
+		return "", "", "", false
+	}
+	switch sampled {
+	case "", "1", "d", "true":
+		flags = "01"
+	case "0", "false":
+		flags = "00"
+	default:
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+// fillTrace takes request id and trace context from incoming headers, B3 ones
+// are used when there is no valid traceparent. A new span id is generated for
+// the request itself, the caller's span becomes the parent. Missing or
+// malformed values are replaced with generated ones. Request id already
+// echoed in response headers wins, so the error handler logs the same id as
+// the middleware.
+func (ar *AccessRecord) fillTrace(h http.Header, resp http.Header, idHeader string) {
+	ar.RequestID = resp.Get(idHeader)
+	if ar.RequestID == "" {
+		ar.RequestID = h.Get(idHeader)
+	}
+	if !validRequestID(ar.RequestID) {
+		ar.RequestID = newID(16)
+	}
+	ar.TraceFlags = "01"
+	if traceID, parentID, flags, ok := ParseTraceparent(h.Get(traceparentHeader)); ok {
+		ar.TraceID = traceID
+		ar.ParentSpanID = parentID
+		ar.TraceFlags = flags
+		ar.TraceState = h.Get(tracestateHeader)
+	} else if traceID, parentID, flags, ok := ParseB3(h); ok {
+		ar.TraceID = traceID
+		ar.ParentSpanID = parentID
+		ar.TraceFlags = flags
+	} else {
+		ar.TraceID = newID(16)
+	}
+	ar.SpanID = newID(8)
+}
+
+// Traceparent returns header value for calls made on behalf of the request
+func (ar *AccessRecord) Traceparent() string {
+	return "00-" + ar.TraceID + "-" + ar.SpanID + "-" + ar.TraceFlags
+}
@@ -0,0 +1,130 @@
+package ECMSLogger
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		flags  string
+		ok     bool
+	}{
+		{"00-" + testTraceID + "-" + testSpanID + "-01", "01", true},
+		{"  00-" + testTraceID + "-" + testSpanID + "-00 ", "00", true},
+		// future versions may add fields
+		{"01-" + testTraceID + "-" + testSpanID + "-01-extra", "01", true},
+		{"", "", false},
+		{"00-" + testTraceID + "-" + testSpanID, "", false},
+		{"00-" + testTraceID + "-" + testSpanID + "-01-extra", "", false},
+		{"ff-" + testTraceID + "-" + testSpanID + "-01", "", false},
+		{"0-" + testTraceID + "-" + testSpanID + "-01", "", false},
+		{"00-" + strings.ToUpper(testTraceID) + "-" + testSpanID + "-01", "", false},
+		{"00-" + strings.Repeat("0", 32) + "-" + testSpanID + "-01", "", false},
+		{"00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", "", false},
+		{"00-" + testTraceID[:31] + "-" + testSpanID + "-01", "", false},
+		{"00-" + testTraceID + "-" + testSpanID + "-1", "", false},
+		{"00-" + testTraceID + "-" + testSpanID + "-zz", "", false},
+	} {
+		traceID, parentID, flags, ok := ParseTraceparent(tt.header)
+		if ok != tt.ok {
+			t.Errorf("%q: ok %v", tt.header, ok)
+			continue
+		}
+		if ok && (traceID != testTraceID || parentID != testSpanID || flags != tt.flags) {
+			t.Errorf("%q: %s %s %s", tt.header, traceID, parentID, flags)
+		}
+	}
+}
+
+func TestParseB3(t *testing.T) {
+	short := testTraceID[16:]
+	for _, tt := range []struct {
+		name    string
+		headers map[string]string
+		traceID string
+		flags   string
+		ok      bool
+	}{
+		{"single", map[string]string{"b3": testTraceID + "-" + testSpanID}, testTraceID, "01", true},
+		{"single sampled with parent", map[string]string{"b3": testTraceID + "-" + testSpanID + "-1-" + testSpanID}, testTraceID, "01", true},
+		{"single not sampled", map[string]string{"b3": testTraceID + "-" + testSpanID + "-0"}, testTraceID, "00", true},
+		{"single debug", map[string]string{"b3": testTraceID + "-" + testSpanID + "-d"}, testTraceID, "01", true},
+		{"single 64-bit", map[string]string{"b3": short + "-" + testSpanID}, strings.Repeat("0", 16) + short, "01", true},
+		{"multi", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "0"}, testTraceID, "00", true},
+		{"multi debug", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": testSpanID, "X-B3-Sampled": "0", "X-B3-Flags": "1"}, testTraceID, "01", true},
+		{"none", map[string]string{}, "", "", false},
+		{"deny only", map[string]string{"b3": "0"}, "", "", false},
+		{"single without span", map[string]string{"b3": testTraceID}, "", "", false},
+		{"single too many fields", map[string]string{"b3": testTraceID + "-" + testSpanID + "-1-" + testSpanID + "-x"}, "", "", false},
+		{"wrong sampled", map[string]string{"b3": testTraceID + "-" + testSpanID + "-yes"}, "", "", false},
+		{"wrong trace id length", map[string]string{"b3": testTraceID[:20] + "-" + testSpanID}, "", "", false},
+		{"zero span", map[string]string{"X-B3-TraceId": testTraceID, "X-B3-SpanId": strings.Repeat("0", 16)}, "", "", false},
+		{"upper case", map[string]string{"X-B3-TraceId": strings.ToUpper(testTraceID), "X-B3-SpanId": testSpanID}, "", "", false},
+	} {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		traceID, parentID, flags, ok := ParseB3(h)
+		if ok != tt.ok {
+			t.Errorf("%s: ok %v", tt.name, ok)
+			continue
+		}
+		if ok && (traceID != tt.traceID || parentID != testSpanID || flags != tt.flags) {
+			t.Errorf("%s: %s %s %s", tt.name, traceID, parentID, flags)
+		}
+	}
+}
+
+func TestFillTrace(t *testing.T) {
+	traceparent := "00-" + testTraceID + "-" + testSpanID + "-01"
+	for _, tt := range []struct {
+		name      string
+		headers   map[string]string
+		response  string
+		requestID string
+		traceID   string
+	}{
+		{"generated", map[string]string{}, "", "", ""},
+		{"incoming", map[string]string{"X-Request-ID": "abc-1", "traceparent": traceparent}, "", "abc-1", testTraceID},
+		{"echoed wins", map[string]string{"X-Request-ID": "abc-1"}, "abc-2", "abc-2", ""},
+		{"request id with space", map[string]string{"X-Request-ID": "a b"}, "", "", ""},
+		{"request id too long", map[string]string{"X-Request-ID": strings.Repeat("a", maxRequestIDLength+1)}, "", "", ""},
+		{"b3 fallback", map[string]string{"b3": testTraceID + "-" + testSpanID + "-0"}, "", "", testTraceID},
+		{"traceparent before b3", map[string]string{"traceparent": traceparent, "b3": strings.Repeat("1", 32) + "-" + testSpanID}, "", "", testTraceID},
+		{"malformed traceparent", map[string]string{"traceparent": "00-xyz"}, "", "", ""},
+	} {
+		h, resp := http.Header{}, http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if tt.response != "" {
+			resp.Set(defaultRequestIDHeader, tt.response)
+		}
+		ar := AccessRecord{}
+		ar.fillTrace(h, resp, defaultRequestIDHeader)
+		if tt.requestID != "" && ar.RequestID != tt.requestID || tt.requestID == "" && !isLowerHex(ar.RequestID, 32) {
+			t.Errorf("%s: request id %q", tt.name, ar.RequestID)
+		}
+		if tt.traceID != "" && (ar.TraceID != tt.traceID || ar.ParentSpanID != testSpanID) {
+			t.Errorf("%s: trace %s parent %s", tt.name, ar.TraceID, ar.ParentSpanID)
+		}
+		if tt.traceID == "" && (!isLowerHex(ar.TraceID, 32) || ar.ParentSpanID != "" || ar.TraceFlags != "01") {
+			t.Errorf("%s: generated trace %s parent %s flags %s", tt.name, ar.TraceID, ar.ParentSpanID, ar.TraceFlags)
+		}
+		if !isLowerHex(ar.SpanID, 16) || ar.SpanID == testSpanID {
+			t.Errorf("%s: span %s", tt.name, ar.SpanID)
+		}
+		if got := ar.Traceparent(); got != "00-"+ar.TraceID+"-"+ar.SpanID+"-"+ar.TraceFlags {
+			t.Errorf("%s: traceparent %s", tt.name, got)
+		}
+	}
+}
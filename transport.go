@@ -0,0 +1,116 @@
+package ECMSLogger
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	inboundKind  = "inbound"
+	outboundKind = "outbound"
+)
+
+// ClickhouseTransport logs calls made to other services. Records get
+// kind=outbound and share request id and trace id with the inbound request
+// found in the request context, the inbound span becomes the parent span.
+// Records go to Middleware or, if it is nil, to the middleware of the
+// inbound request. Calls made outside of both are not logged.
+//
+// The record is sent when the response body is closed or read till the end,
+// so duration includes reading the body.
+type ClickhouseTransport struct {
+	// Base is http.DefaultTransport if nil
+	Base       http.RoundTripper
+	Middleware *Middleware
+	// Propagate sets request id and traceparent headers on outgoing requests
+	Propagate bool
+}
+
+func (t *ClickhouseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	m := t.Middleware
+	if in := FromContext(req.Context()); m == nil && in != nil {
+		m = in.m
+	}
+	if m == nil {
+		return base.RoundTrip(req)
+	}
+	l := m.newOutboundLog(req)
+	if t.Propagate {
+		req = req.Clone(req.Context())
+		req.Header.Set(l.s.requestIDHeader, l.record.RequestID)
+		req.Header.Set(traceparentHeader, l.record.Traceparent())
+		if l.record.TraceState != "" {
+			req.Header.Set(tracestateHeader, l.record.TraceState)
+		}
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		l.record.Error = err.Error()
+		l.finish(0, 0, nil)
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64, err error) {
+		if err != nil {
+			l.record.Error = err.Error()
+		}
+		l.finish(resp.StatusCode, n, resp.Header)
+	}}
+	return resp, nil
+}
+
+func (m *Middleware) newOutboundLog(req *http.Request) *RequestLog {
+	l := m.startRequestLog()
+	l.record.Kind = outboundKind
+	l.record.TraceFlags = "01"
+	if in := FromContext(req.Context()); in != nil {
+		l.record.RequestID = in.record.RequestID
+		l.record.TraceID = in.record.TraceID
+		l.record.ParentSpanID = in.record.SpanID
+		l.record.TraceFlags = in.record.TraceFlags
+		l.record.TraceState = in.record.TraceState
+		l.record.User = in.record.User
+	} else {
+		l.record.RequestID = newID(16)
+		l.record.TraceID = newID(16)
+	}
+	l.record.SpanID = newID(8)
+	l.record.Host = req.URL.Host
+	l.record.Method = req.Method
+	l.record.RequestURI = req.URL.RequestURI()
+	l.record.ContentLength = req.ContentLength
+	l.record.UserAgent = req.Header.Get("User-Agent")
+	l.record.RequestHeaders = l.s.captureHeaders(req.Header, l.s.headers.Request)
+	p, _ := json.Marshal(req.URL.Query())
+	l.record.Params = string(p)
+	return l
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64, err error)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b.n, nil) })
+	} else if err != nil {
+		b.once.Do(func() { b.done(b.n, err) })
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n, nil) })
+	return err
+}
@@ -0,0 +1,118 @@
+package ECMSLogger
+
+// uapRegexes is a subset of uap-core regexes.yaml
+// (https://github.com/ua-parser/uap-core) covering the most common clients.
+// Set userAgent.rules in config to use the complete upstream file.
+const uapRegexes = `
+user_agent_parsers:
+  # crawlers
+  - regex: '(Googlebot|Googlebot-Image|Googlebot-News|Googlebot-Video|AdsBot-Google|Mediapartners-Google|bingbot|BingPreview|YandexBot|YandexMobileBot|YandexImages|Baiduspider|DuckDuckBot|Applebot|PetalBot|Sogou web spider|Exabot|AhrefsBot|SemrushBot|MJ12bot|DotBot|ia_archiver)(?:[/ ;+]*v?(\d+)(?:\.(\d+))?(?:\.(\d+))?)?'
+  - regex: '(Yahoo! Slurp)'
+  - regex: '(facebookexternalhit|Facebot|Twitterbot|LinkedInBot|Slackbot|TelegramBot|Discordbot|WhatsApp)(?:/(\d+)(?:\.(\d+))?(?:\.(\d+))?)?'
+  - regex: '([A-Za-z][A-Za-z0-9_\-]*(?:[Bb]ot|[Cc]rawler|[Ss]pider))(?:[/ ](\d+)(?:\.(\d+))?(?:\.(\d+))?)?'
+
+  # libraries and tools
+  - regex: '(curl|Wget|python-requests|Python-urllib|Go-http-client|okhttp|PostmanRuntime|axios|Apache-HttpClient|libwww-perl|HTTPie)/(\d+)(?:\.(\d+))?(?:\.(\d+))?'
+
+  # browsers, more specific first
+  - regex: '(YaBrowser)/(\d+)\.(\d+)\.(\d+)'
+    family_replacement: 'Yandex Browser'
+  - regex: '(Edg|Edge|EdgA|EdgiOS)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Edge'
+  - regex: '(OPR|OPiOS)/(\d+)\.(\d+)(?:\.(\d+))?'
+    family_replacement: 'Opera'
+  - regex: '(Opera Mini)/(\d+)\.(\d+)'
+  - regex: '(Opera)/.+Version/(\d+)\.(\d+)'
+  - regex: '(SamsungBrowser)/(\d+)\.(\d+)'
+    family_replacement: 'Samsung Internet'
+  - regex: '(UCBrowser)/(\d+)\.(\d+)\.(\d+)'
+    family_replacement: 'UC Browser'
+  - regex: '(Vivaldi)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(Brave)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(FxiOS)/(\d+)\.(\d+)'
+    family_replacement: 'Firefox iOS'
+  - regex: '(CriOS)/(\d+)\.(\d+)\.(\d+)'
+    family_replacement: 'Chrome Mobile iOS'
+  - regex: '; wv\).+(Chrome)/(\d+)\.(\d+)\.(\d+)'
+    family_replacement: 'Chrome Mobile WebView'
+  - regex: '(Chrome)/(\d+)\.(\d+)\.(\d+)[\d.]* Mobile'
+    family_replacement: 'Chrome Mobile'
+  - regex: '(Chromium)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(HeadlessChrome)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '(Chrome)/(\d+)\.(\d+)\.(\d+)'
+  - regex: '\(Android.+Mobile.+(Firefox)/(\d+)\.(\d+)'
+    family_replacement: 'Firefox Mobile'
+  - regex: '(Firefox)/(\d+)\.(\d+)(?:\.(\d+))?'
+  - regex: '(MSIE) (\d+)\.(\d+)'
+    family_replacement: 'IE'
+  - regex: '(Trident)/7\.0.*rv:(\d+)\.(\d+)'
+    family_replacement: 'IE'
+  - regex: '(Version)/(\d+)\.(\d+)(?:\.(\d+))?.*Mobile.*Safari/'
+    family_replacement: 'Mobile Safari'
+  - regex: '(Version)/(\d+)\.(\d+)(?:\.(\d+))?.*Safari/'
+    family_replacement: 'Safari'
+  - regex: '(iPhone|iPad|iPod).*AppleWebKit'
+    family_replacement: 'Mobile Safari UI/WKWebView'
+
+os_parsers:
+  - regex: '(Windows Phone) (?:OS[ /])?(\d+)\.(\d+)'
+  - regex: 'Windows NT 10\.0'
+    os_replacement: 'Windows'
+    os_v1_replacement: '10'
+  - regex: 'Windows NT 6\.3'
+    os_replacement: 'Windows'
+    os_v1_replacement: '8.1'
+  - regex: 'Windows NT 6\.2'
+    os_replacement: 'Windows'
+    os_v1_replacement: '8'
+  - regex: 'Windows NT 6\.1'
+    os_replacement: 'Windows'
+    os_v1_replacement: '7'
+  - regex: 'Windows NT 6\.0'
+    os_replacement: 'Windows'
+    os_v1_replacement: 'Vista'
+  - regex: 'Windows NT 5\.1'
+    os_replacement: 'Windows'
+    os_v1_replacement: 'XP'
+  - regex: '(Windows)'
+  - regex: '(CPU[ +]OS|iPhone[ +]OS|CPU[ +]iPhone|CPU IPhone OS)[ +]+(\d+)[_\.](\d+)(?:[_\.](\d+))?'
+    os_replacement: 'iOS'
+  - regex: '(iPhone|iPad|iPod)'
+    os_replacement: 'iOS'
+  - regex: '(Mac OS X)[ _](\d+)[_.](\d+)(?:[_.](\d+))?'
+  - regex: '(Macintosh)'
+    os_replacement: 'Mac OS X'
+  - regex: '(Android)[ \-/](\d+)(?:\.(\d+))?(?:\.(\d+))?'
+  - regex: '(Android)'
+  - regex: '(CrOS) [a-z0-9_]+ (\d+)\.(\d+)(?:\.(\d+))?'
+    os_replacement: 'Chrome OS'
+  - regex: '(Ubuntu)(?:[/ ](\d+)\.(\d+))?'
+  - regex: '(Fedora)'
+  - regex: '(FreeBSD|OpenBSD|NetBSD)'
+  - regex: '(Linux)'
+
+device_parsers:
+  - regex: '(?:[Bb]ot|[Cc]rawler|[Ss]pider|Slurp|facebookexternalhit|Facebot|ia_archiver|BingPreview|Mediapartners-Google)'
+    device_replacement: 'Spider'
+    brand_replacement: 'Spider'
+  - regex: '(iPad)'
+    device_replacement: 'iPad'
+    brand_replacement: 'Apple'
+  - regex: '(iPhone)'
+    device_replacement: 'iPhone'
+    brand_replacement: 'Apple'
+  - regex: '(iPod)'
+    device_replacement: 'iPod'
+    brand_replacement: 'Apple'
+  - regex: '(Macintosh)'
+    device_replacement: 'Mac'
+    brand_replacement: 'Apple'
+  - regex: '; *(SM-[A-Z0-9]+)'
+    device_replacement: 'Samsung $1'
+    brand_replacement: 'Samsung'
+    model_replacement: '$1'
+  - regex: '; *(Pixel[^;)]*?)(?: Build|\))'
+    brand_replacement: 'Google'
+  - regex: 'Android [^;]+; *([^;)]+?)(?: Build|\))'
+    brand_replacement: 'Generic_Android'
+`
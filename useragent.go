@@ -0,0 +1,238 @@
+package ECMSLogger
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultUACacheSize = 4096
+
+// uapRule is a single entry of uap-core regexes.yaml. The same struct is used
+// for user_agent_parsers, os_parsers and device_parsers.
+type uapRule struct {
+	Regex     string `yaml:"regex"`
+	RegexFlag string `yaml:"regex_flag"`
+
+	FamilyReplacement string `yaml:"family_replacement"`
+	V1Replacement     string `yaml:"v1_replacement"`
+	V2Replacement     string `yaml:"v2_replacement"`
+	V3Replacement     string `yaml:"v3_replacement"`
+
+	OSReplacement   string `yaml:"os_replacement"`
+	OSV1Replacement string `yaml:"os_v1_replacement"`
+	OSV2Replacement string `yaml:"os_v2_replacement"`
+	OSV3Replacement string `yaml:"os_v3_replacement"`
+
+	DeviceReplacement string `yaml:"device_replacement"`
+	BrandReplacement  string `yaml:"brand_replacement"`
+	ModelReplacement  string `yaml:"model_replacement"`
+
+	re *regexp.Regexp
+}
+
+type uapFile struct {
+	UserAgentParsers []uapRule `yaml:"user_agent_parsers"`
+	OSParsers        []uapRule `yaml:"os_parsers"`
+	DeviceParsers    []uapRule `yaml:"device_parsers"`
+}
+
+type UAInfo struct {
+	Browser        string
+	BrowserVersion string
+	OS             string
+	OSVersion      string
+	Device         string
+	DeviceType     string
+	IsBot          bool
+}
+
+type UAParser struct {
+	ua        []uapRule
+	os        []uapRule
+	device    []uapRule
+	mu        sync.Mutex
+	cache     map[string]UAInfo
+	cacheSize int
+}
+
+// NewUAParser builds a parser from uap-core compatible YAML. Rules which use
+// regexp features unsupported by Go (lookarounds, backreferences) are skipped.
+func NewUAParser(data []byte, cacheSize int) (*UAParser, error) {
+	f := uapFile{}
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	p := &UAParser{cacheSize: cacheSize}
+	if p.cacheSize == 0 {
+		p.cacheSize = defaultUACacheSize
+	}
+	p.cache = make(map[string]UAInfo)
+	p.ua = compileUAPRules(f.UserAgentParsers)
+	p.os = compileUAPRules(f.OSParsers)
+	p.device = compileUAPRules(f.DeviceParsers)
+	if len(p.ua) == 0 && len(p.os) == 0 && len(p.device) == 0 {
+		return nil, errors.New("No user agent rules found")
+	}
+	return p, nil
+}
+
+func compileUAPRules(rules []uapRule) []uapRule {
+	res := make([]uapRule, 0, len(rules))
+	for _, r := range rules {
+		expr := r.Regex
+		if r.RegexFlag == "i" {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			log.Debug("Skipping user agent rule ", r.Regex, ": ", err)
+			continue
+		}
+		r.re = re
+		res = append(res, r)
+	}
+	return res
+}
+
+func (p *UAParser) Parse(ua string) UAInfo {
+	if ua == "" {
+		return UAInfo{}
+	}
+	p.mu.Lock()
+	info, ok := p.cache[ua]
+	p.mu.Unlock()
+	if ok {
+		return info
+	}
+	info = p.parse(ua)
+	p.mu.Lock()
+	if len(p.cache) >= p.cacheSize {
+		p.cache = make(map[string]UAInfo)
+	}
+	p.cache[ua] = info
+	p.mu.Unlock()
+	return info
+}
+
+func (p *UAParser) parse(ua string) UAInfo {
+	info := UAInfo{Browser: "Other", OS: "Other", Device: "Other"}
+	for _, r := range p.ua {
+		m := r.re.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		info.Browser = uapValue(r.FamilyReplacement, m, 1)
+		info.BrowserVersion = joinVersion(
+			uapValue(r.V1Replacement, m, 2),
+			uapValue(r.V2Replacement, m, 3),
+			uapValue(r.V3Replacement, m, 4),
+		)
+		break
+	}
+	for _, r := range p.os {
+		m := r.re.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		info.OS = uapValue(r.OSReplacement, m, 1)
+		info.OSVersion = joinVersion(
+			uapValue(r.OSV1Replacement, m, 2),
+			uapValue(r.OSV2Replacement, m, 3),
+			uapValue(r.OSV3Replacement, m, 4),
+		)
+		break
+	}
+	for _, r := range p.device {
+		m := r.re.FindStringSubmatch(ua)
+		if m == nil {
+			continue
+		}
+		info.Device = uapValue(r.DeviceReplacement, m, 1)
+		break
+	}
+	info.IsBot = info.Device == "Spider"
+	info.DeviceType = deviceType(ua, &info)
+	return info
+}
+
+// uapValue implements uap-core replacement semantics: a replacement string
+// with $N placeholders wins over the N-th group
+func uapValue(replacement string, m []string, group int) string {
+	if replacement != "" {
+		if !strings.Contains(replacement, "$") {
+			return replacement
+		}
+		for i := len(m) - 1; i >= 1; i-- {
+			replacement = strings.Replace(replacement, "$"+strconv.Itoa(i), m[i], -1)
+		}
+		return strings.TrimSpace(replacement)
+	}
+	if group < len(m) {
+		return m[group]
+	}
+	return ""
+}
+
+func joinVersion(parts ...string) string {
+	res := []string{}
+	for _, p := range parts {
+		if p == "" {
+			break
+		}
+		res = append(res, p)
+	}
+	return strings.Join(res, ".")
+}
+
+func deviceType(ua string, info *UAInfo) string {
+	switch {
+	case info.IsBot:
+		return "bot"
+	case info.Device == "iPad" || strings.Contains(ua, "Tablet") || strings.Contains(ua, "Kindle") ||
+		strings.Contains(ua, "Silk/") || (strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile")):
+		return "tablet"
+	case strings.Contains(ua, "Mobile") || strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPod") ||
+		strings.Contains(ua, "Windows Phone") || strings.Contains(ua, "Opera Mini"):
+		return "mobile"
+	case info.OS == "Other":
+		return "other"
+	default:
+		return "desktop"
+	}
+}
+
+func initUAParser(ua *UserAgent) (*UAParser, error) {
+	if ua.Disabled {
+		return nil, nil
+	}
+	data := []byte(uapRegexes)
+	if ua.Rules != "" {
+		var err error
+		data, err = ioutil.ReadFile(ua.Rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewUAParser(data, ua.CacheSize)
+}
+
+// fillUserAgent completes fields which were not sent by our clients in
+// X-OS/X-Browser headers
+func (ar *AccessRecord) fillUserAgent(info UAInfo) {
+	if ar.OS == "" {
+		ar.OS = info.OS
+		ar.OSVersion = info.OSVersion
+	}
+	if ar.Browser == "" {
+		ar.Browser = info.Browser
+		ar.BrowserVersion = info.BrowserVersion
+	}
+	ar.DeviceType = info.DeviceType
+	ar.IsBot = info.IsBot
+}
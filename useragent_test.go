@@ -0,0 +1,126 @@
+package ECMSLogger
+
+import (
+	"testing"
+)
+
+func TestUAParserEmbeddedRules(t *testing.T) {
+	p, err := initUAParser(&UserAgent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ua   string
+		want UAInfo
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.110 Safari/537.36",
+			UAInfo{Browser: "Chrome", BrowserVersion: "120.0.6099", OS: "Windows", OSVersion: "10", Device: "Other", DeviceType: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			UAInfo{Browser: "Edge", BrowserVersion: "120.0.2210", OS: "Windows", OSVersion: "10", Device: "Other", DeviceType: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+			UAInfo{Browser: "Safari", BrowserVersion: "17.1", OS: "Mac OS X", OSVersion: "10.15.7", Device: "Mac", DeviceType: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			UAInfo{Browser: "Firefox", BrowserVersion: "121.0", OS: "Ubuntu", Device: "Other", DeviceType: "desktop"},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			UAInfo{Browser: "Mobile Safari", BrowserVersion: "17.1", OS: "iOS", OSVersion: "17.1.2", Device: "iPhone", DeviceType: "mobile"},
+		},
+		{
+			"Mozilla/5.0 (iPad; CPU OS 16_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.6 Mobile/15E148 Safari/604.1",
+			UAInfo{Browser: "Mobile Safari", BrowserVersion: "16.6", OS: "iOS", OSVersion: "16.6", Device: "iPad", DeviceType: "tablet"},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36",
+			UAInfo{Browser: "Chrome Mobile", BrowserVersion: "120.0.6099", OS: "Android", OSVersion: "14", Device: "Pixel 8", DeviceType: "mobile"},
+		},
+		// Android without Mobile is a tablet
+		{
+			"Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36",
+			UAInfo{Browser: "Chrome", BrowserVersion: "119.0.0", OS: "Android", OSVersion: "13", Device: "Samsung SM-X700", DeviceType: "tablet"},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UAInfo{Browser: "Googlebot", BrowserVersion: "2.1", OS: "Other", Device: "Spider", DeviceType: "bot", IsBot: true},
+		},
+		{
+			"curl/8.4.0",
+			UAInfo{Browser: "curl", BrowserVersion: "8.4.0", OS: "Other", Device: "Other", DeviceType: "other"},
+		},
+		{
+			"something else",
+			UAInfo{Browser: "Other", OS: "Other", Device: "Other", DeviceType: "other"},
+		},
+		{"", UAInfo{}},
+	} {
+		// the second call is answered from the cache
+		for i := 0; i < 2; i++ {
+			if got := p.Parse(tt.ua); got != tt.want {
+				t.Errorf("%q:\n got %+v\nwant %+v", tt.ua, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestUAParserRules(t *testing.T) {
+	rules := `
+user_agent_parsers:
+  - regex: '(?<=x)MyApp'
+  - regex: '(myapp)/(\d+)\.(\d+)'
+    regex_flag: 'i'
+    family_replacement: 'My App'
+  - regex: '(Tool) (\d+)'
+    family_replacement: '$1 Pro'
+    v1_replacement: '9'
+os_parsers:
+  - regex: 'Plan ?(\d)'
+    os_replacement: 'Plan $1'
+device_parsers:
+  - regex: 'Robot'
+    device_replacement: 'Spider'
+`
+	p, err := NewUAParser([]byte(rules), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.ua) != 2 {
+		t.Errorf("%d rules, lookbehind is not skipped", len(p.ua))
+	}
+	for _, tt := range []struct {
+		ua   string
+		want UAInfo
+	}{
+		{"MYAPP/3.14 (Plan9)", UAInfo{Browser: "My App", BrowserVersion: "3.14", OS: "Plan 9", Device: "Other", DeviceType: "desktop"}},
+		{"Tool 5", UAInfo{Browser: "Tool Pro", BrowserVersion: "9", OS: "Other", Device: "Other", DeviceType: "other"}},
+		{"Tool 5 Robot", UAInfo{Browser: "Tool Pro", BrowserVersion: "9", OS: "Other", Device: "Spider", DeviceType: "bot", IsBot: true}},
+	} {
+		if got := p.Parse(tt.ua); got != tt.want {
+			t.Errorf("%q:\n got %+v\nwant %+v", tt.ua, got, tt.want)
+		}
+	}
+	if _, err := NewUAParser([]byte("user_agent_parsers: []\n"), 0); err == nil {
+		t.Error("rules without parsers are accepted")
+	}
+}
+
+func TestFillUserAgent(t *testing.T) {
+	info := UAInfo{Browser: "Chrome", BrowserVersion: "120", OS: "Android", OSVersion: "14", DeviceType: "mobile"}
+	// our clients send X-OS and X-Browser, they win over the parser
+	ar := AccessRecord{OS: "MyOS", Browser: "MyApp"}
+	ar.fillUserAgent(info)
+	if ar.OS != "MyOS" || ar.OSVersion != "" || ar.Browser != "MyApp" || ar.DeviceType != "mobile" {
+		t.Errorf("%+v", ar)
+	}
+	ar = AccessRecord{}
+	ar.fillUserAgent(info)
+	if ar.OS != "Android" || ar.OSVersion != "14" || ar.Browser != "Chrome" || ar.BrowserVersion != "120" {
+		t.Errorf("%+v", ar)
+	}
+}
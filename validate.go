@@ -0,0 +1,499 @@
+package ECMSLogger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults applied by Config.Validate
+const (
+	DefaultBatchSize    = 100
+	DefaultMaxQueueSize = 1000
+	DefaultPeriod       = 10 * time.Second
+	DefaultHost         = "127.0.0.1"
+	DefaultPort         = "9000"
+	DefaultUser         = "default"
+	DefaultDB           = "default"
+	DefaultTimeout      = 5 * time.Second
+	DefaultMaxFiles     = 10
+	DefaultMaxSize      = "10m"
+	DefaultCompression  = "gzip"
+	DefaultSinkName     = "access"
+	DefaultSinkMaxSize  = "100m"
+	DefaultSinkQueue    = 1000
+	DefaultKafkaClient  = "ecms-logger"
+	DefaultKafkaKey     = "request_id"
+	DefaultKafkaBatch   = 500
+	DefaultKafkaPeriod  = time.Second
+	DefaultKafkaRetries = 3
+	DefaultKafkaQueue   = 10000
+	ReserveEvict        = "evict"
+	ReserveStop         = "stop"
+)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+type ValidationError struct {
+	// YAML path of the field, e.g. clickhouse.reserve.rotate.maxSize
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, v := range e {
+		lines[i] = v.Error()
+	}
+	return "invalid config:\n  " + strings.Join(lines, "\n  ")
+}
+
+func (e *ValidationErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate fills documented defaults and checks the whole config. All
+// problems are returned at once as ValidationErrors. It does not look at the
+// file system, see CheckPaths.
+func (c *Config) Validate() error {
+	errs := ValidationErrors{}
+	c.validateMaxMind(&errs)
+	c.validateClickhouse(&errs)
+	c.validateFeatures(&errs)
+	c.validateSinks(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CheckPaths checks that files and directories of a validated config exist
+// on this host. The logger checks them again when it opens them, so it is
+// only needed to catch mistakes early, e.g. by ecms-logger validate -paths.
+func (c *Config) CheckPaths() error {
+	errs := ValidationErrors{}
+	checkFile(&errs, "maxmind.db", c.MaxMind.DB)
+	checkFile(&errs, "userAgent.rules", c.UserAgent.Rules)
+	checkFile(&errs, "bots.asnDB", c.Bots.ASNDB)
+	if r := c.Clickhouse.Reserve; r != nil {
+		checkDir(&errs, "clickhouse.reserve.dir", r.Dir)
+	}
+	if f := c.Sinks.File; f != nil {
+		checkDir(&errs, "sinks.file.dir", f.Dir)
+	}
+	if k := c.Sinks.Kafka; k != nil && k.Reserve != nil {
+		checkDir(&errs, "sinks.kafka.reserve.dir", k.Reserve.Dir)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkFile(errs *ValidationErrors, path string, filename string) {
+	if filename == "" {
+		return
+	}
+	if _, err := os.Stat(filename); err != nil {
+		errs.add(path, "cannot access %s: %v", filename, err)
+	}
+}
+
+func checkDir(errs *ValidationErrors, path string, dir string) {
+	if dir == "" {
+		return
+	}
+	if info, err := os.Stat(dir); err != nil {
+		errs.add(path, "cannot access %s: %v", dir, err)
+	} else if !info.IsDir() {
+		errs.add(path, "%s is not a directory", dir)
+	}
+}
+
+func (c *Config) validateMaxMind(errs *ValidationErrors) {
+	if c.MaxMind.DB == "" {
+		errs.add("maxmind.db", "path to MaxMind City database is required")
+	}
+	remote := c.MaxMind.Source["remoteAddr"]
+	header := c.MaxMind.Source["header"]
+	switch {
+	case remote == "true" && header != "":
+		errs.add("maxmind.source", "set either header or remoteAddr, not both")
+	case remote != "" && remote != "true" && remote != "false":
+		errs.add("maxmind.source.remoteAddr", "must be true or false, got %q", remote)
+	case remote != "true" && header == "":
+		errs.add("maxmind.source", "header or remoteAddr: true is required")
+	}
+}
+
+func (c *Config) validateClickhouse(errs *ValidationErrors) {
+	if !c.Clickhouse.Disabled {
+		c.Clickhouse.validate(errs)
+	}
+}
+
+// validate fills defaults of the clickhouse section, NewLogger uses it for
+// settings which did not come from ReadConfig
+func (cs *ClickhouseSettings) validate(errs *ValidationErrors) {
+	if cs.Table == "" {
+		errs.add("clickhouse.table", "table name is required")
+	} else if !identifierRegex.MatchString(cs.Table) {
+		errs.add("clickhouse.table", "%q is not a valid table name", cs.Table)
+	}
+	if cs.BatchSize == 0 {
+		cs.BatchSize = DefaultBatchSize
+	}
+	if cs.MaxQueueSize == 0 {
+		cs.MaxQueueSize = DefaultMaxQueueSize
+		if cs.MaxQueueSize <= cs.BatchSize {
+			cs.MaxQueueSize = cs.BatchSize * 2
+		}
+	}
+	if cs.BatchSize < 0 {
+		errs.add("clickhouse.batchSize", "must be positive, got %d", cs.BatchSize)
+	}
+	if cs.MaxQueueSize <= cs.BatchSize {
+		errs.add("clickhouse.maxQueueSize", "must be more than batchSize (%d), got %d", cs.BatchSize, cs.MaxQueueSize)
+	}
+	if cs.Period == 0 {
+		cs.Period = DefaultPeriod
+	} else if cs.Period < 0 {
+		errs.add("clickhouse.period", "must be positive, got %s", cs.Period)
+	}
+
+	conn := &cs.Connection
+	if conn.Host == "" {
+		conn.Host = DefaultHost
+	}
+	if conn.Port == "" {
+		conn.Port = DefaultPort
+	} else if p, err := strconv.Atoi(conn.Port); err != nil || p <= 0 || p > 65535 {
+		errs.add("clickhouse.connection.port", "%q is not a valid port", conn.Port)
+	}
+	if conn.User == "" {
+		conn.User = DefaultUser
+	}
+	if conn.DB == "" {
+		conn.DB = DefaultDB
+	}
+	if conn.Timeout == 0 {
+		conn.Timeout = DefaultTimeout
+	}
+	if conn.ConnLimit < 0 {
+		errs.add("clickhouse.connection.connLimit", "must not be negative")
+	}
+	if conn.IdleLimit < 0 {
+		errs.add("clickhouse.connection.idleLimit", "must not be negative")
+	}
+	if conn.ConnLimit > 0 && conn.IdleLimit > conn.ConnLimit {
+		errs.add("clickhouse.connection.idleLimit", "must not be more than connLimit (%d)", conn.ConnLimit)
+	}
+
+	if cs.Reserve != nil {
+		validateReserve(errs, "clickhouse.reserve", cs.Reserve)
+	}
+}
+
+// validateReserve checks a reserve of clickhouse or of a sink at path
+func validateReserve(errs *ValidationErrors, path string, r *Reserve) {
+	if r.Dir == "" {
+		errs.add(path+".dir", "directory is required when reserve is set")
+	}
+	if r.Rotate.MaxFiles == 0 {
+		r.Rotate.MaxFiles = DefaultMaxFiles
+	} else if r.Rotate.MaxFiles < 0 {
+		errs.add(path+".rotate.maxFiles", "must be positive, got %d", r.Rotate.MaxFiles)
+	}
+	if r.Rotate.MaxSize == "" {
+		r.Rotate.MaxSize = DefaultMaxSize
+	} else if ParseSize(r.Rotate.MaxSize) <= 0 {
+		errs.add(path+".rotate.maxSize", "%q is not a size, use number with b, k, m or g suffix", r.Rotate.MaxSize)
+	}
+	if r.Compression == "" {
+		r.Compression = DefaultCompression
+	} else if _, ok := compressionCodes[r.Compression]; !ok {
+		errs.add(path+".compression", "%q is not supported, use gzip, zstd or none", r.Compression)
+	}
+	if r.MaxTotalSize != "" && ParseSize(r.MaxTotalSize) <= 0 {
+		errs.add(path+".maxTotalSize", "%q is not a size, use number with b, k, m or g suffix", r.MaxTotalSize)
+	}
+	if r.MinFreePercent < 0 || r.MinFreePercent >= 100 {
+		errs.add(path+".minFreePercent", "must be in [0, 100), got %v", r.MinFreePercent)
+	}
+	if r.OnFull == "" {
+		r.OnFull = ReserveEvict
+	} else if r.OnFull != ReserveEvict && r.OnFull != ReserveStop {
+		errs.add(path+".onFull", "%q is not supported, use evict or stop", r.OnFull)
+	}
+	if _, err := NewReserveKeys(r.Encryption); err != nil {
+		errs.add(path+".encryption", "%v", err)
+	}
+}
+
+func (c *Config) validateSinks(errs *ValidationErrors) {
+	if c.Clickhouse.Disabled && c.Sinks.File == nil && c.Sinks.Stdout == nil && c.Sinks.Kafka == nil {
+		errs.add("sinks", "at least one sink is required when clickhouse is disabled")
+	}
+	c.validateStdoutSink(errs)
+	c.validateKafkaSink(errs)
+	if f := c.Sinks.File; f != nil {
+		if f.Dir == "" {
+			errs.add("sinks.file.dir", "directory is required")
+		}
+		if f.Name == "" {
+			f.Name = DefaultSinkName
+		}
+		if _, err := newRecordFormatter(f.Format); err != nil {
+			errs.add("sinks.file.format", "%q is not supported, use json, logfmt or combined", f.Format)
+		} else if f.Format == "" {
+			f.Format = FormatJSON
+		}
+		if f.MaxSize == "" {
+			f.MaxSize = DefaultSinkMaxSize
+		} else if ParseSize(f.MaxSize) <= 0 {
+			errs.add("sinks.file.maxSize", "%q is not a size, use number with b, k, m or g suffix", f.MaxSize)
+		}
+		if f.MaxTotalSize != "" && ParseSize(f.MaxTotalSize) <= 0 {
+			errs.add("sinks.file.maxTotalSize", "%q is not a size, use number with b, k, m or g suffix", f.MaxTotalSize)
+		}
+		if f.Period < 0 {
+			errs.add("sinks.file.period", "must not be negative")
+		}
+		if f.MaxFiles < 0 {
+			errs.add("sinks.file.maxFiles", "must not be negative")
+		}
+		if f.MaxAge < 0 {
+			errs.add("sinks.file.maxAge", "must not be negative")
+		}
+		if f.QueueSize == 0 {
+			f.QueueSize = DefaultSinkQueue
+		} else if f.QueueSize < 0 {
+			errs.add("sinks.file.queueSize", "must be positive")
+		}
+	}
+}
+
+func (c *Config) validateStdoutSink(errs *ValidationErrors) {
+	s := c.Sinks.Stdout
+	if s == nil {
+		return
+	}
+	if s.Stream == "" {
+		s.Stream = "stdout"
+	} else if s.Stream != "stdout" && s.Stream != "stderr" {
+		errs.add("sinks.stdout.stream", "%q is not supported, use stdout or stderr", s.Stream)
+	}
+	if s.Naming == "" {
+		s.Naming = NamingSnake
+	}
+	if _, err := newJSONFormatter(s.Naming, s.Fields, s.OmitEmpty); err != nil {
+		if s.Naming != NamingSnake && s.Naming != NamingCamel {
+			errs.add("sinks.stdout.naming", "%q is not supported, use snake or camel", s.Naming)
+		} else {
+			errs.add("sinks.stdout.fields", "%v", err)
+		}
+	}
+	if s.QueueSize == 0 {
+		s.QueueSize = DefaultSinkQueue
+	} else if s.QueueSize < 0 {
+		errs.add("sinks.stdout.queueSize", "must be positive")
+	}
+}
+
+func (c *Config) validateKafkaSink(errs *ValidationErrors) {
+	k := c.Sinks.Kafka
+	if k == nil {
+		return
+	}
+	if len(k.Brokers) == 0 {
+		errs.add("sinks.kafka.brokers", "at least one broker is required")
+	}
+	for _, b := range k.Brokers {
+		if _, port, err := net.SplitHostPort(b); err != nil || port == "" {
+			errs.add("sinks.kafka.brokers", "%q is not host:port", b)
+		}
+	}
+	if k.Topic == "" {
+		errs.add("sinks.kafka.topic", "topic is required")
+	}
+	if k.ClientID == "" {
+		k.ClientID = DefaultKafkaClient
+	}
+	if k.Key == "" {
+		k.Key = DefaultKafkaKey
+	}
+	if _, err := kafkaKeyField(k.Key); err != nil {
+		errs.add("sinks.kafka.key", "%q is not a column", k.Key)
+	}
+	if _, err := newKafkaFormatter(k.Format); err != nil {
+		errs.add("sinks.kafka.format", "%q is not supported, use json or protobuf", k.Format)
+	} else if k.Format == "" {
+		k.Format = KafkaFormatJSON
+	}
+	if k.Acks == "" {
+		k.Acks = "all"
+	} else if _, ok := kafkaAcks[k.Acks]; !ok {
+		errs.add("sinks.kafka.acks", "%q is not supported, use all, leader or none", k.Acks)
+	}
+	if k.Idempotent && k.Acks != "all" {
+		errs.add("sinks.kafka.idempotent", "requires acks: all")
+	}
+	if k.Compression == "" {
+		k.Compression = "none"
+	} else if _, ok := kafkaCompression[k.Compression]; !ok {
+		errs.add("sinks.kafka.compression", "%q is not supported, use none, gzip, snappy, lz4 or zstd", k.Compression)
+	}
+	if k.BatchSize == 0 {
+		k.BatchSize = DefaultKafkaBatch
+	} else if k.BatchSize < 0 {
+		errs.add("sinks.kafka.batchSize", "must be positive, got %d", k.BatchSize)
+	}
+	if k.Period == 0 {
+		k.Period = DefaultKafkaPeriod
+	} else if k.Period < 0 {
+		errs.add("sinks.kafka.period", "must be positive, got %s", k.Period)
+	}
+	if k.Timeout == 0 {
+		k.Timeout = DefaultTimeout
+	} else if k.Timeout < 0 {
+		errs.add("sinks.kafka.timeout", "must be positive, got %s", k.Timeout)
+	}
+	if k.Retries == 0 {
+		k.Retries = DefaultKafkaRetries
+	} else if k.Retries < 0 {
+		errs.add("sinks.kafka.retries", "must not be negative")
+	}
+	if k.QueueSize == 0 {
+		k.QueueSize = DefaultKafkaQueue
+	} else if k.QueueSize < 0 {
+		errs.add("sinks.kafka.queueSize", "must be positive")
+	}
+	if t := k.TLS; t != nil && (t.CertFile == "") != (t.KeyFile == "") {
+		errs.add("sinks.kafka.tls", "certFile and keyFile go together")
+	}
+	if a := k.SASL; a != nil {
+		if _, err := newKafkaSASL(a); err != nil {
+			errs.add("sinks.kafka.sasl.mechanism", "%q is not supported, use plain, scram-sha-256 or scram-sha-512", a.Mechanism)
+		}
+		if a.User == "" {
+			errs.add("sinks.kafka.sasl.user", "user is required")
+		}
+	}
+	if k.Reserve != nil {
+		validateReserve(errs, "sinks.kafka.reserve", k.Reserve)
+	}
+}
+
+func (c *Config) validateFeatures(errs *ValidationErrors) {
+	if _, err := NewRedactor(&c.Redaction); err != nil {
+		errs.add("redaction", "%v", err)
+	}
+	for i, h := range c.Headers.Redact {
+		if !headerInList(h, c.Headers.Request) && !headerInList(h, c.Headers.Response) {
+			errs.add(fmt.Sprintf("headers.redact[%d]", i), "%s is not captured, add it to request or response list", h)
+		}
+	}
+	if c.UserAgent.CacheSize < 0 {
+		errs.add("userAgent.cacheSize", "must not be negative")
+	}
+	for i, p := range c.Bots.Patterns {
+		path := fmt.Sprintf("bots.patterns[%d]", i)
+		if p.Name == "" {
+			errs.add(path+".name", "name is required")
+		}
+		if _, err := regexp.Compile(p.Regex); err != nil {
+			errs.add(path+".regex", "%v", err)
+		}
+	}
+	c.validateSampling(errs)
+	if c.Tracing.RequestIDHeader == "" {
+		c.Tracing.RequestIDHeader = defaultRequestIDHeader
+	}
+	if c.Metrics.Path == "" {
+		c.Metrics.Path = defaultMetricsPath
+	} else if !strings.HasPrefix(c.Metrics.Path, "/") {
+		errs.add("metrics.path", "must start with /")
+	}
+	if c.Health.Path == "" {
+		c.Health.Path = defaultHealthPath
+	} else if !strings.HasPrefix(c.Health.Path, "/") {
+		errs.add("health.path", "must start with /")
+	}
+	if c.Health.Enabled && c.Metrics.Enabled && c.Health.Path == c.Metrics.Path {
+		errs.add("health.path", "same as metrics.path")
+	}
+	if c.Health.Timeout == 0 {
+		c.Health.Timeout = defaultHealthTimeout
+	}
+	c.Health.Thresholds = c.Health.thresholds()
+	t := c.Health.Thresholds
+	checkDurationThreshold(errs, "health.thresholds.flushAge", t.FlushAge)
+	checkDurationThreshold(errs, "health.thresholds.geoipAge", t.GeoIPAge)
+	checkRatioThreshold(errs, "health.thresholds.queueFill", t.QueueFill)
+	checkRatioThreshold(errs, "health.thresholds.reserveFill", t.ReserveFill)
+}
+
+func (c *Config) validateSampling(errs *ValidationErrors) {
+	s := &c.Sampling
+	if s.DefaultRate != nil && (*s.DefaultRate < 0 || *s.DefaultRate > 1) {
+		errs.add("sampling.defaultRate", "must be in [0, 1], got %v", *s.DefaultRate)
+	}
+	if s.SlowerThan < 0 {
+		errs.add("sampling.slowerThan", "must not be negative")
+	}
+	for i, r := range s.Rules {
+		path := fmt.Sprintf("sampling.rules[%d]", i)
+		if r.Rate != nil && (*r.Rate < 0 || *r.Rate > 1) {
+			errs.add(path+".rate", "must be in [0, 1], got %v", *r.Rate)
+		}
+		if r.Skip && r.Rate != nil {
+			errs.add(path, "skip and rate are mutually exclusive")
+		}
+		for j, st := range r.Status {
+			if !statusPattern.MatchString(strings.ToLower(st)) {
+				errs.add(fmt.Sprintf("%s.status[%d]", path, j), "%q is not a status code or mask like 5xx", st)
+			}
+		}
+		for j, code := range r.RPCCodes {
+			if !validRPCCode(code) {
+				errs.add(fmt.Sprintf("%s.rpcCodes[%d]", path, j), "%q is not a gRPC code like NotFound", code)
+			}
+		}
+		if r.UserAgent != "" {
+			if _, err := regexp.Compile(r.UserAgent); err != nil {
+				errs.add(path+".userAgent", "%v", err)
+			}
+		}
+		if r.Path == "" && len(r.Methods) == 0 && len(r.Status) == 0 && len(r.RPCCodes) == 0 && r.UserAgent == "" {
+			errs.add(path, "rule matches every request, set path, methods, status, rpcCodes or userAgent")
+		}
+	}
+}
+
+func checkDurationThreshold(errs *ValidationErrors, path string, t DurationThreshold) {
+	if t.Degraded < 0 || t.Unhealthy < 0 {
+		errs.add(path, "must not be negative")
+	}
+	if t.Degraded > 0 && t.Unhealthy > 0 && t.Degraded > t.Unhealthy {
+		errs.add(path+".degraded", "must not be more than unhealthy (%s)", t.Unhealthy)
+	}
+}
+
+func checkRatioThreshold(errs *ValidationErrors, path string, t RatioThreshold) {
+	if t.Degraded < 0 || t.Unhealthy < 0 || t.Degraded > 1 || t.Unhealthy > 1 {
+		errs.add(path, "must be in [0, 1]")
+	}
+	if t.Degraded > 0 && t.Unhealthy > 0 && t.Degraded > t.Unhealthy {
+		errs.add(path+".degraded", "must not be more than unhealthy (%v)", t.Unhealthy)
+	}
+}